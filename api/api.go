@@ -0,0 +1,358 @@
+// Package api exposes the publisher's fetch and publish code paths over an
+// authenticated REST API, for republishing requests on demand.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/mskcc/smile-message-publisher-go/lims"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/metrics"
+	"github.com/mskcc/smile-message-publisher-go/smile"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Run statuses.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// maxRuns is the number of runs kept for GET /runs/{id}.
+const maxRuns = 1000
+
+// maxJSONBody bounds the size of a request posted to /publish/json.
+const maxJSONBody = 32 << 20
+
+// Run summarizes one publish triggered through the API.
+type Run struct {
+	Id             string     `json:"id"`
+	Source         string     `json:"source"`
+	RequestIds     []string   `json:"requestIds,omitempty"`
+	Status         string     `json:"status"`
+	StartedAt      time.Time  `json:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+	Failures       []Failure  `json:"failures,omitempty"`
+	FailureSummary string     `json:"failureSummary,omitempty"`
+
+	done chan struct{}
+}
+
+// Failure describes one failed request of a run.
+type Failure struct {
+	Error string `json:"error"`
+	Class string `json:"class"` // the types error class, or "other"
+}
+
+// Server runs publishes requested through the API, one goroutine per run.
+type Server struct {
+	ctx   context.Context
+	args  types.Arguments
+	m     *messaging.Messaging
+	token string
+
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	runs        map[string]*Run
+	order       []string
+	lastStarted time.Time
+}
+
+// New returns a Server publishing with m, reading LimsRest, SMILE and topic
+// settings from args.  Callers must present token as a Bearer token.  Runs
+// are bound by ctx.
+func New(ctx context.Context, args types.Arguments, m *messaging.Messaging, token string) *Server {
+	return &Server{ctx: ctx, args: args, m: m, token: token, runs: map[string]*Run{}}
+}
+
+// Handler returns the API routes, plus unauthenticated Prometheus metrics
+// at /metrics and health probes at /healthz and /readyz.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", only(http.MethodGet, metrics.Handler().ServeHTTP))
+	mux.HandleFunc("/healthz", only(http.MethodGet, s.healthz))
+	mux.HandleFunc("/readyz", only(http.MethodGet, s.readyz))
+	mux.HandleFunc("/publish/lims/", only(http.MethodPost, s.auth(s.publishLims)))
+	mux.HandleFunc("/publish/smile/", only(http.MethodPost, s.auth(s.publishSmile)))
+	mux.HandleFunc("/publish/json", only(http.MethodPost, s.auth(s.publishJSON)))
+	mux.HandleFunc("/runs/", only(http.MethodGet, s.auth(s.getRun)))
+	return mux
+}
+
+// only restricts h to requests using method.
+func only(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Wait blocks until every run has finished or ctx is done, reporting
+// whether the runs finished.
+func (s *Server) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="smile-message-publisher"`)
+			writeError(w, http.StatusUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// validRequestId reports whether id is a well-formed IGO request id, made
+// of letters, digits and underscores only.
+func validRequestId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) publishLims(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/publish/lims/")
+	if !validRequestId(id) {
+		writeError(w, http.StatusBadRequest, "Invalid request id")
+		return
+	}
+	s.respond(w, r, s.startLims([]string{id}))
+}
+
+func (s *Server) publishSmile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/publish/smile/")
+	if !validRequestId(id) {
+		writeError(w, http.StatusBadRequest, "Invalid request id")
+		return
+	}
+	s.respond(w, r, s.startSmile([]string{id}))
+}
+
+func (s *Server) startLims(reqIds []string) *Run {
+	return s.start(messaging.SourceLims, reqIds, func(ctx context.Context, args types.Arguments) error {
+		return lims.FetchRequests(ctx, s.m, reqIds, args)
+	})
+}
+
+func (s *Server) startSmile(reqIds []string) *Run {
+	return s.start(messaging.SourceSmile, reqIds, func(ctx context.Context, args types.Arguments) error {
+		args.ReqIds = reqIds
+		return smile.FetchRequests(ctx, s.m, args)
+	})
+}
+
+// Command is a publish request received on the NATS command subject.
+type Command struct {
+	Source     string   `json:"source"` // lims or smile
+	RequestIds []string `json:"requestIds"`
+}
+
+// BusyReply is the reply to a command received while the serve command is
+// already running as many commands as it takes at once.
+var BusyReply = errorReply("Busy: too many commands in progress, try again later")
+
+// HandleCommand executes the JSON Command in data, waiting for the run to
+// finish, and returns the JSON reply: the run summary, or {"error": ...} if
+// the command is invalid.
+func (s *Server) HandleCommand(data []byte) []byte {
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return errorReply("Invalid command: " + err.Error())
+	}
+	if len(cmd.RequestIds) == 0 {
+		return errorReply("Invalid command: no requestIds")
+	}
+	for _, id := range cmd.RequestIds {
+		if !validRequestId(id) {
+			return errorReply("Invalid command: invalid request id " + strconv.Quote(id))
+		}
+	}
+	var run *Run
+	switch cmd.Source {
+	case messaging.SourceLims:
+		run = s.startLims(cmd.RequestIds)
+	case messaging.SourceSmile:
+		run = s.startSmile(cmd.RequestIds)
+	default:
+		return errorReply("Invalid command: source must be lims or smile")
+	}
+	<-run.done
+	b, _ := json.Marshal(s.snapshot(run))
+	return b
+}
+
+func (s *Server) publishJSON(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, "Body is not valid JSON")
+		return
+	}
+	var probe struct {
+		RequestId string `json:"requestId"`
+	}
+	json.Unmarshal(body, &probe)
+	if probe.RequestId == "" {
+		writeError(w, http.StatusBadRequest, "Missing requestId")
+		return
+	}
+	s.respond(w, r, s.start(messaging.SourceAPI, []string{probe.RequestId}, func(ctx context.Context, args types.Arguments) error {
+		_, err := lims.PublishRequestJSON(ctx, s.m, body, messaging.SourceAPI, args)
+		return err
+	}))
+}
+
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	run, ok := s.runs[strings.TrimPrefix(r.URL.Path, "/runs/")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown run")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.snapshot(run))
+}
+
+// respond answers a publish with 202 and the running run, or with ?wait=true
+// waits for the run to finish and answers 200 with its summary.
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, run *Run) {
+	w.Header().Set("Location", "/runs/"+run.Id)
+	if r.URL.Query().Get("wait") != "true" {
+		writeJSON(w, http.StatusAccepted, s.snapshot(run))
+		return
+	}
+	select {
+	case <-run.done:
+		writeJSON(w, http.StatusOK, s.snapshot(run))
+	case <-r.Context().Done():
+	}
+}
+
+// start records a new run and executes fn for it in the background.
+func (s *Server) start(source string, reqIds []string, fn func(context.Context, types.Arguments) error) *Run {
+	run := &Run{Id: types.NewRunId(), Source: source, RequestIds: reqIds, Status: StatusRunning,
+		StartedAt: time.Now().UTC(), done: make(chan struct{})}
+	s.mu.Lock()
+	s.runs[run.Id] = run
+	s.order = append(s.order, run.Id)
+	s.lastStarted = run.StartedAt
+	s.evict()
+	s.mu.Unlock()
+
+	args := s.args
+	args.RunId = run.Id
+	args.APIMode = true
+	args.JournalDir = "" // runs are tracked by the API instead
+	logger := slog.With("api_run_id", run.Id, "source", source, "request_ids", reqIds)
+	logger.Info("Starting run requested through API")
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := fn(s.ctx, args)
+		s.finish(run, err)
+		if err != nil {
+			logger.Warn("Run requested through API failed", "error", err)
+		} else {
+			logger.Info("Run requested through API succeeded")
+		}
+	}()
+	return run
+}
+
+func (s *Server) finish(run *Run, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	run.FinishedAt = &now
+	run.Status = StatusSucceeded
+	if err != nil {
+		run.Status = StatusFailed
+		errs := []error{err}
+		if j, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = j.Unwrap()
+		}
+		for _, e := range errs {
+			class := "other"
+			if k := types.Kind(e); k != nil {
+				class = k.Error()
+			}
+			run.Failures = append(run.Failures, Failure{Error: e.Error(), Class: class})
+		}
+		run.FailureSummary = types.SummarizeErrors(errs)
+	}
+	close(run.done)
+}
+
+// evict drops the oldest finished runs beyond maxRuns.  s.mu must be held.
+func (s *Server) evict() {
+	for i := 0; len(s.runs) > maxRuns && i < len(s.order); {
+		id := s.order[i]
+		if s.runs[id].Status == StatusRunning {
+			i++
+			continue
+		}
+		delete(s.runs, id)
+		s.order = append(s.order[:i], s.order[i+1:]...)
+	}
+}
+
+// snapshot copies run so it can be encoded without holding s.mu.
+func (s *Server) snapshot(run *Run) Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *run
+	c.Failures = append([]Failure(nil), run.Failures...)
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Error writing API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func errorReply(msg string) []byte {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	return b
+}
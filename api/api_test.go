@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mskcc/smile-message-publisher-go/fakelims"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPI_publishLimsReportsRunSummary(t *testing.T) {
+	lims := httptest.NewServer(fakelims.New("fake", "fake"))
+	defer lims.Close()
+	args := types.Arguments{LimsHost: strings.TrimPrefix(lims.URL, "http://"), LimsScheme: "http",
+		LimsUser: "fake", LimsPW: "fake", LimsPubTop: "igo.request"}
+	srv := New(context.Background(), args, nil, "s3cret")
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	do := func(method, path, token string, body string) (*http.Response, Run) {
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var run Run
+		json.NewDecoder(resp.Body).Decode(&run)
+		return resp, run
+	}
+
+	if resp, _ := do("POST", "/publish/lims/99999", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Bad token got status %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := do("POST", "/publish/lims/99999%26igoSampleId=1", "s3cret", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Bad request id got status %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := do("GET", "/publish/lims/99999", "s3cret", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET publish got status %d, want 405", resp.StatusCode)
+	}
+	if resp, _ := do("POST", "/publish/json", "s3cret", "{not json"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Bad JSON got status %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := do("POST", "/publish/json", "s3cret", `{"samples":[]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("JSON without requestId got status %d, want 400", resp.StatusCode)
+	}
+
+	// the fake LIMS is empty, so the run fails fetching before publishing
+	resp, run := do("POST", "/publish/lims/99999?wait=true", "s3cret", "")
+	if resp.StatusCode != http.StatusOK || run.Status != StatusFailed || run.Source != "lims" {
+		t.Fatalf("Unexpected response %d: %+v", resp.StatusCode, run)
+	}
+	if len(run.Failures) != 1 || run.Failures[0].Class != "not found" || run.FinishedAt == nil {
+		t.Errorf("Unexpected failures: %+v", run)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/runs/"+run.Id {
+		t.Errorf("Location = %q", loc)
+	}
+
+	resp, got := do("GET", "/runs/"+run.Id, "s3cret", "")
+	if resp.StatusCode != http.StatusOK || got.Id != run.Id || got.Status != StatusFailed {
+		t.Errorf("GET /runs/%s = %d %+v", run.Id, resp.StatusCode, got)
+	}
+	if resp, _ := do("GET", "/runs/unknown", "s3cret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Unknown run got status %d, want 404", resp.StatusCode)
+	}
+	if !srv.Wait(context.Background()) {
+		t.Error("Runs did not finish")
+	}
+}
+
+func TestAPI_HandleCommand(t *testing.T) {
+	lims := httptest.NewServer(fakelims.New("fake", "fake"))
+	defer lims.Close()
+	args := types.Arguments{LimsHost: strings.TrimPrefix(lims.URL, "http://"), LimsScheme: "http",
+		LimsUser: "fake", LimsPW: "fake", LimsPubTop: "igo.request"}
+	srv := New(context.Background(), args, nil, "s3cret")
+
+	for cmd, want := range map[string]string{
+		`{"source":"lims"`:                          "Invalid command: unexpected end of JSON input",
+		`{"source":"lims","requestIds":[]}`:         "Invalid command: no requestIds",
+		`{"source":"other","requestIds":["13370"]}`: "Invalid command: source must be lims or smile",
+		`{"source":"lims","requestIds":["1&x=2"]}`:  `Invalid command: invalid request id "1&x=2"`,
+	} {
+		var reply map[string]string
+		json.Unmarshal(srv.HandleCommand([]byte(cmd)), &reply)
+		if reply["error"] != want {
+			t.Errorf("HandleCommand(%s) error = %q, want %q", cmd, reply["error"], want)
+		}
+	}
+
+	var run Run
+	json.Unmarshal(srv.HandleCommand([]byte(`{"source":"lims","requestIds":["99998","99999"]}`)), &run)
+	if run.Status != StatusFailed || len(run.RequestIds) != 2 || len(run.Failures) != 2 || run.FailureSummary != "2 not found" {
+		t.Errorf("Unexpected run: %+v", run)
+	}
+}
+
+func TestAPI_readyzFailsWithoutNats(t *testing.T) {
+	srv := New(context.Background(), types.Arguments{}, nil, "s3cret")
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	get := func(path string) (int, Health) {
+		resp, err := http.Get(api.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var h Health
+		json.NewDecoder(resp.Body).Decode(&h)
+		return resp.StatusCode, h
+	}
+	if code, h := get("/healthz"); code != http.StatusOK || h.Status != "ok" || len(h.Problems) != 0 {
+		t.Errorf("GET /healthz = %d %+v, want 200 ok", code, h)
+	}
+	if code, h := get("/readyz"); code != http.StatusServiceUnavailable || h.Status != "unavailable" || len(h.Problems) != 1 {
+		t.Errorf("GET /readyz = %d %+v, want 503 unavailable", code, h)
+	}
+}
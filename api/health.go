@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/lims"
+	"net/http"
+	"time"
+)
+
+// Health is the body of /readyz.
+type Health struct {
+	Status           string     `json:"status"` // ok, or unavailable when not ready
+	Nats             string     `json:"nats"`
+	LimsLastSuccess  *time.Time `json:"limsLastSuccess,omitempty"`
+	LimsFailingSince *time.Time `json:"limsFailingSince,omitempty"`
+	LastRunStartedAt *time.Time `json:"lastRunStartedAt,omitempty"`
+	Backlog          int        `json:"backlog"` // runs in progress
+	Problems         []string   `json:"problems,omitempty"`
+}
+
+// health reports the state of the daemon's dependencies and work.  It is
+// not ready while NATS is disconnected or LimsRest calls have been failing
+// for longer than args.LimsFailureGrace.
+func (s *Server) health() Health {
+	h := Health{Status: "ok", Nats: "NOT CONFIGURED"}
+	if s.m != nil {
+		h.Nats = s.m.Status()
+	}
+	if s.m == nil || !s.m.Connected() {
+		h.Problems = append(h.Problems, "NATS connection is "+h.Nats)
+	}
+	lastSuccess, failingSince := fetch.Health(lims.Endpoints...)
+	h.LimsLastSuccess = timePtr(lastSuccess)
+	h.LimsFailingSince = timePtr(failingSince)
+	if !failingSince.IsZero() && time.Since(failingSince) > s.args.LimsFailureGrace {
+		h.Problems = append(h.Problems, fmt.Sprintf("LimsRest calls failing since %s", failingSince.UTC().Format(time.RFC3339)))
+	}
+
+	s.mu.Lock()
+	h.LastRunStartedAt = timePtr(s.lastStarted)
+	for _, run := range s.runs {
+		if run.Status == StatusRunning {
+			h.Backlog++
+		}
+	}
+	s.mu.Unlock()
+	if len(h.Problems) > 0 {
+		h.Status = "unavailable"
+	}
+	return h
+}
+
+// healthz is the liveness probe: the daemon is serving.  The state of its
+// dependencies is left to readyz.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz is the readiness probe, failing with 503 while any problem is
+// reported.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	h := s.health()
+	status := http.StatusOK
+	if len(h.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix prefixes the environment variables overriding config properties
+// and flags, e.g. SMILE_PUB_LIMS_PASSWORD overrides lims.password.
+const envPrefix = "SMILE_PUB"
+
+// configKeys lists the scalar config file properties.  Each may also be
+// given as a <key>_file property naming a file holding its value.
+var configKeys = []string{
+	"lims.host",
+	"lims.username",
+	"lims.password",
+	"lims.publisher_topic",
+	"lims.sample_topic",
+	"lims.scheme",
+	"lims.rate_limit",
+	"lims.rate_burst",
+	"nats.url",
+	"nats.auth",
+	"nats.consumer_name",
+	"nats.consumer_password",
+	"nats.keystore_path",
+	"nats.truststore_path",
+	"nats.token",
+	"nats.nkey_seed_path",
+	"nats.creds_path",
+	"nats.jetstream",
+	"nats.ack_timeout",
+	"nats.stream",
+	"nats.flush_timeout",
+	"nats.command_subject",
+	"nats.command_queue",
+	"smile.request_url",
+	"smile.publisher_topic",
+	"smile.rate_limit",
+	"smile.rate_burst",
+	"api.token",
+}
+
+// setupEnv lets every config property and flag be overridden by an
+// environment variable named after it.
+func setupEnv() {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+}
+
+// resolveSecretFiles replaces each property with the contents of the file
+// named by its <key>_file variant, if set, as mounted by Kubernetes or
+// Docker secrets.  The _file variant takes precedence over a direct value.
+func resolveSecretFiles() error {
+	for _, key := range configKeys {
+		path := viper.GetString(key + "_file")
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read %s_file: %s", key, err)
+		}
+		viper.Set(key, strings.TrimRight(string(b), "\r\n"))
+	}
+	return nil
+}
+
+// isSecret reports whether the value of key must never be logged or dumped.
+func isSecret(key string) bool {
+	return strings.Contains(key, "password") || strings.HasSuffix(key, "token")
+}
+
+// dumpConfig writes the effective config, after environment and secret file
+// overrides, to w as YAML with secrets redacted.
+func dumpConfig(w io.Writer) error {
+	settings := map[string]map[string]interface{}{}
+	set := func(key string, val interface{}) {
+		parts := strings.SplitN(key, ".", 2)
+		if settings[parts[0]] == nil {
+			settings[parts[0]] = map[string]interface{}{}
+		}
+		settings[parts[0]][parts[1]] = val
+	}
+	for _, key := range configKeys {
+		if !viper.IsSet(key) {
+			continue
+		}
+		val := viper.Get(key)
+		if isSecret(key) && viper.GetString(key) != "" {
+			val = "REDACTED"
+		}
+		set(key, val)
+		if path := viper.GetString(key + "_file"); path != "" {
+			set(key+"_file", path)
+		}
+	}
+	if hdrs := viper.GetStringMapString("nats.headers"); len(hdrs) > 0 {
+		set("nats.headers", hdrs)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// configChecker accumulates every problem found while reading the config,
+// so they can be reported together.
+type configChecker struct {
+	errs []error
+}
+
+func (c *configChecker) fail(format string, a ...interface{}) {
+	c.errs = append(c.errs, fmt.Errorf(format, a...))
+}
+
+// str returns the value of key, recording a problem if it is required and
+// missing.
+func (c *configChecker) str(key string, required bool) string {
+	v := viper.GetString(key)
+	if v == "" && required {
+		c.fail("Missing %s property in config file", key)
+	}
+	return v
+}
+
+// url returns the value of key, recording a problem if it is missing, does
+// not parse, has no host or uses a scheme other than those given.
+func (c *configChecker) url(key string, schemes ...string) string {
+	v := c.str(key, true)
+	if v == "" {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		c.fail("Malformed %s property in config file: %q", key, v)
+		return v
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return u.String()
+		}
+	}
+	c.fail("Malformed %s property in config file: scheme must be one of %s", key, strings.Join(schemes, ", "))
+	return v
+}
+
+// host returns the value of key, recording a problem unless it is a bare
+// host or host:port.
+func (c *configChecker) host(key string) string {
+	v := c.str(key, true)
+	if v == "" {
+		return v
+	}
+	host := v
+	if strings.Contains(v, ":") {
+		var err error
+		if host, _, err = net.SplitHostPort(v); err != nil {
+			c.fail("Malformed %s property in config file: %s", key, err)
+			return v
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		c.fail("Malformed %s property in config file: expecting host[:port], got %q", key, v)
+	}
+	return v
+}
+
+// file returns the value of key, recording a problem if it is missing or
+// does not name a readable file.
+func (c *configChecker) file(key string) string {
+	v := c.str(key, true)
+	if v == "" {
+		return v
+	}
+	if fi, err := os.Stat(v); err != nil {
+		c.fail("Invalid %s property in config file: %s", key, err)
+	} else if fi.IsDir() {
+		c.fail("Invalid %s property in config file: %s is a directory", key, v)
+	}
+	return v
+}
+
+// duration returns the value of key, or def if unset, recording a problem
+// unless it is a positive duration.
+func (c *configChecker) duration(key, def string) time.Duration {
+	viper.SetDefault(key, def)
+	d, err := time.ParseDuration(viper.GetString(key))
+	if err != nil || d <= 0 {
+		c.fail("Malformed %s property in config file: expecting a positive duration such as %s", key, def)
+	}
+	return d
+}
+
+// rateLimit returns the requests per second and burst read from
+// <section>.rate_limit and <section>.rate_burst, recording a problem unless
+// they are a non-negative number and a positive integer.  The rate defaults
+// to 0, unlimited, and the burst to 1.
+func (c *configChecker) rateLimit(section string) (float64, int) {
+	viper.SetDefault(section+".rate_limit", 0)
+	viper.SetDefault(section+".rate_burst", 1)
+	rps, err := strconv.ParseFloat(viper.GetString(section+".rate_limit"), 64)
+	if err != nil || rps < 0 {
+		c.fail("Malformed %s.rate_limit property in config file: expecting requests per second, 0 for unlimited", section)
+	}
+	burst, err := strconv.Atoi(viper.GetString(section + ".rate_burst"))
+	if err != nil || burst < 1 {
+		c.fail("Malformed %s.rate_burst property in config file: expecting a positive integer", section)
+	}
+	return rps, burst
+}
+
+// readConfig loads the config file and reads the properties used by the
+// mode selected in args.  Sections not used by the mode are not required;
+// with no mode selected every section is.  Recording fixtures needs neither
+// publish topics nor the nats section, and a dry run needs no nats section.
+// All missing or malformed properties
+// are reported together.
+func readConfig(cfg types.Config, args *types.Arguments) error {
+	viper.SetConfigName(cfg.Name)
+	viper.SetConfigType(cfg.Type)
+	viper.AddConfigPath(cfg.Path)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	if err := applyProfile(args); err != nil {
+		return err
+	}
+	if err := resolveSecretFiles(); err != nil {
+		return err
+	}
+
+	anyMode := args.Mode() == ""
+	publish := !args.RecordMode
+	limsFetch := anyMode || args.ReqIdMode || args.DateMode || args.RetryMode || args.ResumeMode || args.SampleMode
+	c := &configChecker{}
+	if limsFetch {
+		args.LimsHost = c.host("lims.host")
+		args.LimsUser = c.str("lims.username", true)
+		args.LimsPW = c.str("lims.password", true)
+		viper.SetDefault("lims.scheme", "https")
+		if args.LimsScheme = viper.GetString("lims.scheme"); args.LimsScheme != "https" && args.LimsScheme != "http" {
+			c.fail("Malformed lims.scheme property in config file: scheme must be one of https, http")
+		}
+		args.LimsRateLimit, args.LimsRateBurst = c.rateLimit("lims")
+	}
+	args.LimsPubTop = c.str("lims.publisher_topic", publish && ((limsFetch && !args.SampleMode) || args.JSONFileMode))
+	args.LimsSampleTop = c.str("lims.sample_topic", args.SampleMode)
+	if anyMode || args.SmileServiceMode {
+		args.SmileRequestUrl = c.url("smile.request_url", "http", "https")
+		args.SmilePubTop = c.str("smile.publisher_topic", publish)
+		args.SmileRateLimit, args.SmileRateBurst = c.rateLimit("smile")
+	}
+
+	if !publish || args.DryRun {
+		return errors.Join(c.errs...)
+	}
+	args.NatsUrl = c.url("nats.url", "nats", "tls", "ws", "wss")
+	readNatsAuthConfig(c, args)
+	args.NatsHeaders = viper.GetStringMapString("nats.headers")
+	viper.SetDefault("nats.jetstream", true)
+	args.NatsJetStream = viper.GetBool("nats.jetstream")
+	args.NatsAckTimeout = c.duration("nats.ack_timeout", "5s")
+	args.NatsStream = viper.GetString("nats.stream")
+	args.NatsFlushTimeout = c.duration("nats.flush_timeout", "10s")
+	args.NatsCommandSubj = viper.GetString("nats.command_subject")
+	viper.SetDefault("nats.command_queue", "smile-message-publisher")
+	args.NatsCommandQueue = viper.GetString("nats.command_queue")
+	viper.SetDefault("nats.command_limit", 4)
+	if args.NatsCommandLimit = viper.GetInt("nats.command_limit"); args.NatsCommandLimit < 1 {
+		c.fail("Malformed nats.command_limit property in config file: expecting a positive integer")
+	}
+	return errors.Join(c.errs...)
+}
+
+// applyProfile merges the profile selected with --profile over the base
+// sections of the config file.  Properties the profile does not set are
+// inherited from the base; environment variables still take precedence.
+func applyProfile(args *types.Arguments) error {
+	if args.Profile = viper.GetString("profile"); args.Profile == "" {
+		return nil
+	}
+	key := "profiles." + args.Profile
+	if !viper.IsSet(key) {
+		var names []string
+		for name := range viper.GetStringMap("profiles") {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown profile %s, config file defines: %s", args.Profile, strings.Join(names, ", "))
+	}
+	profile := viper.GetStringMap(key)
+	args.ProfileProtected = viper.GetBool(key + ".protected")
+	delete(profile, "protected")
+	return viper.MergeConfigMap(profile)
+}
+
+// confirmProfile guards runs against a protected profile, which must be
+// confirmed with --yes or, on a terminal, by typing the profile name.  Dry
+// runs publish nothing, so need no confirmation.
+func confirmProfile(args types.Arguments, in io.Reader, out io.Writer, interactive bool) error {
+	if !args.ProfileProtected || args.DryRun || viper.GetBool("yes") {
+		return nil
+	}
+	if !interactive {
+		return fmt.Errorf("Profile %s is protected, pass --yes to publish to it", args.Profile)
+	}
+	fmt.Fprintf(out, "Profile %s is protected. Type %q to continue: ", args.Profile, args.Profile)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	if strings.TrimSpace(answer) != args.Profile {
+		return fmt.Errorf("Profile %s not confirmed", args.Profile)
+	}
+	return nil
+}
+
+// readNatsAuthConfig reads the settings required by the NATS auth mode
+// selected with nats.auth, which defaults to TLS with user/password.
+func readNatsAuthConfig(c *configChecker, args *types.Arguments) {
+	viper.SetDefault("nats.auth", types.NatsAuthTLS)
+	switch args.NatsAuth = viper.GetString("nats.auth"); args.NatsAuth {
+	case types.NatsAuthTLS:
+		args.NatsConName = c.str("nats.consumer_name", true)
+		args.NatsConPw = c.str("nats.consumer_password", true)
+		nerrs := len(c.errs)
+		args.NatsKeyPath = c.file("nats.keystore_path")
+		args.NatsTrustPath = c.file("nats.truststore_path")
+		if len(c.errs) == nerrs {
+			// the same pairing nats.ClientCert is given by messaging.WithTLS
+			if _, err := tls.LoadX509KeyPair(args.NatsTrustPath, args.NatsKeyPath); err != nil {
+				c.fail("Invalid nats.truststore_path/nats.keystore_path properties in config file: %s", err)
+			}
+		}
+	case types.NatsAuthPlain:
+		// user/password are optional for a local server
+		args.NatsConName = c.str("nats.consumer_name", false)
+		args.NatsConPw = c.str("nats.consumer_password", false)
+	case types.NatsAuthToken:
+		args.NatsToken = c.str("nats.token", true)
+	case types.NatsAuthNkey:
+		args.NatsNkeySeedPath = c.file("nats.nkey_seed_path")
+	case types.NatsAuthCreds:
+		args.NatsCredsPath = c.file("nats.creds_path")
+	default:
+		c.fail("Unknown nats.auth property in config file: %s", args.NatsAuth)
+	}
+}
+
+func parseConfig() (types.Config, error) {
+	toReturn := types.Config{}
+	cf := viper.GetString("cfg_file")
+	if cf == "" {
+		return toReturn, fmt.Errorf("Missing cfg_file argument")
+	}
+	ext := filepath.Ext(cf)
+	name := filepath.Base(cf)
+	toReturn.Name = strings.TrimSuffix(name, ext)
+	toReturn.Type = strings.TrimPrefix(ext, ".")
+	toReturn.Path = filepath.Dir(cf)
+
+	return toReturn, nil
+}
+
+// validateConfig implements the validate-config command, reporting every
+// problem with the config for the selected mode and printing the effective
+// config with secrets redacted.
+func validateConfig() error {
+	_, err := parseArgs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Config problems:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "  - %s\n", line)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "Config is valid")
+	}
+	if viper.ConfigFileUsed() != "" {
+		if derr := dumpConfig(os.Stdout); derr != nil {
+			return derr
+		}
+	}
+	return err
+}
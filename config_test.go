@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfig_secretFilesAndDump(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	setupEnv()
+
+	pwFile := filepath.Join(t.TempDir(), "lims_password")
+	if err := os.WriteFile(pwFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("lims.password", "from-config")
+	t.Setenv("SMILE_PUB_LIMS_PASSWORD_FILE", pwFile)
+	t.Setenv("SMILE_PUB_NATS_TOKEN", "t0ken")
+	t.Setenv("SMILE_PUB_LIMS_HOST", "igolims.mskcc.org:8443")
+
+	if err := resolveSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("lims.password"); got != "s3cret" {
+		t.Errorf("expected password from file, got %q", got)
+	}
+
+	var buf bytes.Buffer
+	if err := dumpConfig(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "s3cret") || strings.Contains(out, "t0ken") {
+		t.Errorf("secret leaked in dump:\n%s", out)
+	}
+	for _, want := range []string{"host: igolims.mskcc.org:8443", "password: REDACTED", "token: REDACTED", "password_file: " + pwFile} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in dump:\n%s", want, out)
+		}
+	}
+}
+
+func TestConfig_readConfigReportsAllProblemsForMode(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	dir := t.TempDir()
+	cf := filepath.Join(dir, "conf.yaml")
+	content := "nats:\n  url: nats://localhost:4222\n  auth: token\n  ack_timeout: soon\nsmile:\n  request_url: igo\n"
+	if err := os.WriteFile(cf, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := types.Config{Name: "conf", Type: "yaml", Path: dir}
+
+	// smile service mode needs neither lims section nor lims topic
+	args := types.Arguments{SmileServiceMode: true}
+	err := readConfig(cfg, &args)
+	if err == nil {
+		t.Fatal("expected config problems")
+	}
+	problems := strings.Split(err.Error(), "\n")
+	expected := []string{
+		`Malformed smile.request_url property in config file: "igo"`,
+		"Missing smile.publisher_topic property in config file",
+		"Missing nats.token property in config file",
+		"Malformed nats.ack_timeout property in config file: expecting a positive duration such as 5s",
+	}
+	if diff := cmp.Diff(expected, problems); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestConfig_dryRunNeedsNoNats(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	dir := t.TempDir()
+	cf := filepath.Join(dir, "conf.yaml")
+	content := "lims:\n  host: lims.example.org\n  username: u\n  password: p\n  publisher_topic: igo.new-request\n"
+	if err := os.WriteFile(cf, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := types.Config{Name: "conf", Type: "yaml", Path: dir}
+
+	args := types.Arguments{ReqIdMode: true, DryRun: true}
+	if err := readConfig(cfg, &args); err != nil {
+		t.Error("Unexpected error reading config for dry run: ", err)
+	}
+	args = types.Arguments{ReqIdMode: true}
+	if err := readConfig(cfg, &args); err == nil || !strings.Contains(err.Error(), "nats.url") {
+		t.Errorf("readConfig() error = %v, want missing nats.url", err)
+	}
+}
+
+func TestConfig_profileInheritsBase(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	dir := t.TempDir()
+	content := `lims:
+  publisher_topic: igo.new-request
+nats:
+  url: nats://localhost:4222
+  auth: plain
+profiles:
+  prod:
+    protected: true
+    nats:
+      url: tls://smile-nats.mskcc.org:4222
+`
+	if err := os.WriteFile(filepath.Join(dir, "conf.yaml"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("profile", "prod")
+	args := types.Arguments{JSONFileMode: true}
+	if err := readConfig(types.Config{Name: "conf", Type: "yaml", Path: dir}, &args); err != nil {
+		t.Fatal(err)
+	}
+	if args.NatsUrl != "tls://smile-nats.mskcc.org:4222" || args.NatsAuth != "plain" || args.LimsPubTop != "igo.new-request" {
+		t.Errorf("profile not merged over base: %+v", args)
+	}
+	if !args.ProfileProtected {
+		t.Error("expected protected profile")
+	}
+
+	if err := confirmProfile(args, strings.NewReader(""), io.Discard, false); err == nil {
+		t.Error("expected non-interactive run against protected profile to fail without --yes")
+	}
+	if err := confirmProfile(args, strings.NewReader("prod\n"), io.Discard, true); err != nil {
+		t.Errorf("expected typed confirmation to succeed: %s", err)
+	}
+	viper.Set("yes", true)
+	if err := confirmProfile(args, strings.NewReader(""), io.Discard, false); err != nil {
+		t.Errorf("expected --yes to confirm: %s", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/fakelims"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// runFakeLims implements the fake-lims command, serving LimsRest calls from
+// the fixtures in --fake_lims_dir and/or --fake_lims_generate generated
+// requests until interrupted.
+func runFakeLims() error {
+	srv := fakelims.New(viper.GetString("fake_lims_user"), viper.GetString("fake_lims_password"))
+	dir := viper.GetString("fake_lims_dir")
+	n := viper.GetInt("fake_lims_generate")
+	if dir == "" && n <= 0 {
+		err := errors.New("fake-lims needs fake_lims_dir and/or fake_lims_generate")
+		slog.Error("Error parsing arguments", "error", err)
+		return err
+	}
+	if dir != "" {
+		if err := srv.LoadDir(dir); err != nil {
+			slog.Error("Error loading fixtures", "dir", dir, "error", err)
+			return err
+		}
+	}
+	if n > 0 {
+		srv.Generate(n, viper.GetInt("fake_lims_samples"), time.Now())
+	}
+
+	ctx, cancel := rootContext(types.Arguments{OverallTimeout: viper.GetDuration("overall_timeout")})
+	defer cancel()
+	addr := viper.GetString("fake_lims_addr")
+	hs := &http.Server{Addr: addr, Handler: srv}
+	errc := make(chan error, 1)
+	go func() { errc <- hs.ListenAndServe() }()
+	slog.Info("Serving fake LimsRest", "url", "http://"+addr+"/LimsRest/api/", "fixtures", dir, "generated", n)
+	select {
+	case err := <-errc:
+		slog.Error("Fake LimsRest stopped", "error", err)
+		return err
+	case <-types.StopRequested(ctx):
+	case <-ctx.Done():
+	}
+	// in-flight calls get 5 seconds, cut short by a second signal or the
+	// overall timeout
+	sctx, scancel := context.WithTimeout(ctx, 5*time.Second)
+	defer scancel()
+	if err := hs.Shutdown(sctx); err != nil {
+		hs.Close()
+	}
+	return nil
+}
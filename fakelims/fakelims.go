@@ -0,0 +1,200 @@
+// Package fakelims is a stand-in for the LimsRest endpoints used by the
+// publisher, serving requests and sample manifests loaded from fixture files
+// or generated, so the publisher and downstream services can run offline.
+package fakelims
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves getDeliveries, getRequestSamples and getSampleManifest
+// under /LimsRest/api/, requiring HTTP Basic auth.
+type Server struct {
+	user      string
+	password  string
+	mu        sync.RWMutex
+	requests  map[string]*igo.Request
+	manifests map[string]*igo.SampleManifest
+}
+
+// New returns an empty Server accepting the given credentials.
+func New(user, password string) *Server {
+	return &Server{
+		user:      user,
+		password:  password,
+		requests:  map[string]*igo.Request{},
+		manifests: map[string]*igo.SampleManifest{},
+	}
+}
+
+// AddRequest adds a request, and the manifests of its samples.
+func (s *Server) AddRequest(req *igo.Request, mans ...*igo.SampleManifest) {
+	s.mu.Lock()
+	s.requests[req.RequestId] = req
+	s.mu.Unlock()
+	s.AddManifests(mans...)
+}
+
+// AddManifests adds sample manifests.
+func (s *Server) AddManifests(mans ...*igo.SampleManifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range mans {
+		s.manifests[m.IgoId] = m
+	}
+}
+
+// LoadDir loads every *.json file in dir, in the layout written by the
+// record-fixtures command: files with a requestId are requests, files with
+// an igoId are sample manifests.
+func (s *Server) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No fixture files in %s", dir)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		var probe struct {
+			RequestId string `json:"requestId"`
+			IgoId     string `json:"igoId"`
+		}
+		if err := json.Unmarshal(b, &probe); err != nil {
+			return fmt.Errorf("Unable to parse fixture %s: %s", f, err)
+		}
+		switch {
+		case probe.RequestId != "":
+			req := &igo.Request{}
+			if err := json.Unmarshal(b, req); err != nil {
+				return fmt.Errorf("Unable to parse fixture %s: %s", f, err)
+			}
+			s.AddRequest(req)
+		case probe.IgoId != "":
+			man := &igo.SampleManifest{}
+			if err := json.Unmarshal(b, man); err != nil {
+				return fmt.Errorf("Unable to parse fixture %s: %s", f, err)
+			}
+			s.AddManifests(man)
+		default:
+			slog.Warn("Skipping fixture with neither requestId nor igoId", "path", f)
+		}
+	}
+	return nil
+}
+
+// Generate adds n requests of samples samples each, delivered one per day
+// in the n days up to end.  Ids start at 90000 so they cannot be mistaken
+// for real IGO requests, and every other request is a CMO request.
+func (s *Server) Generate(n, samples int, end time.Time) {
+	for i := 0; i < n; i++ {
+		reqId := fmt.Sprintf("%d_F", 90000+i)
+		req := &igo.Request{
+			RequestId:    reqId,
+			Recipe:       "IMPACT505",
+			LabHeadName:  "Fake Labhead",
+			LabHeadEmail: "labhead@example.org",
+			IsCmoRequest: i%2 == 0,
+			DeliveryDate: end.AddDate(0, 0, i-n+1).UnixMilli(),
+		}
+		var mans []*igo.SampleManifest
+		for j := 1; j <= samples; j++ {
+			sId := fmt.Sprintf("%s_%d", reqId, j)
+			name := fmt.Sprintf("FAKE-%d-%d", i, j)
+			req.Samples = append(req.Samples, &igo.Request_Samples{
+				InvestigatorSampleId: name,
+				IgoSampleId:          sId,
+				IgoComplete:          true,
+			})
+			tn := "Tumor"
+			if j%2 == 0 {
+				tn = "Normal"
+			}
+			mans = append(mans, &igo.SampleManifest{
+				IgoId:                sId,
+				InvestigatorSampleId: name,
+				SampleName:           name,
+				CmoPatientId:         fmt.Sprintf("C-FAKE%02d", i),
+				TumorOrNormal:        tn,
+				Species:              "Human",
+				BaitSet:              "IMPACT505_BAITS",
+			})
+		}
+		s.AddRequest(req, mans...)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pw, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pw), []byte(s.password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="LimsRest"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch strings.TrimPrefix(r.URL.Path, "/LimsRest/api/") {
+	case "getDeliveries":
+		ts, err := strconv.ParseInt(q.Get("timestamp"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+			return
+		}
+		s.writeJSON(w, r, s.deliveries(ts))
+	case "getRequestSamples":
+		req, ok := s.requests[q.Get("request")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.writeJSON(w, r, req)
+	case "getSampleManifest":
+		// LimsRest answers an unknown sample with an empty list
+		mans := []*igo.SampleManifest{}
+		if m, ok := s.manifests[q.Get("igoSampleId")]; ok {
+			mans = append(mans, m)
+		}
+		s.writeJSON(w, r, mans)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// deliveries returns the requests delivered at or after ts, in
+// milliseconds, oldest first.
+func (s *Server) deliveries(ts int64) []*igo.Delivery {
+	dels := []*igo.Delivery{}
+	for id, req := range s.requests {
+		if req.DeliveryDate >= ts {
+			dels = append(dels, &igo.Delivery{Request: id, DeliveryDate: req.DeliveryDate})
+		}
+	}
+	sort.Slice(dels, func(i, j int) bool { return dels[i].DeliveryDate < dels[j].DeliveryDate })
+	return dels
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	slog.Debug("Serving fake LimsRest call", "url", r.URL.String())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", "url", r.URL.String(), "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package fakelims
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/lims"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeLims_servesPublisherCalls(t *testing.T) {
+	srv := New("fake", "fake")
+	if err := srv.LoadDir("../lims/testdata"); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	srv.Generate(3, 2, end)
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	args := types.Arguments{LimsHost: strings.TrimPrefix(hs.URL, "http://"), LimsScheme: "http",
+		LimsUser: "fake", LimsPW: "fake", StartDate: end.AddDate(0, 0, -1), EndDate: end}
+
+	ids, err := lims.FetchDeliveries(context.Background(), args)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if want := []string{"90001_F", "90002_F"}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("FetchDeliveries() = %v, want %v", ids, want)
+	}
+	rwm, err := lims.FetchRequestWithManifests(context.Background(), "90002_F", args)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if len(rwm.Samples) != 2 || rwm.Samples[1].IgoId != "90002_F_2" || !rwm.IsCmoRequest {
+		t.Errorf("Unexpected request: %v", rwm)
+	}
+	if _, err := lims.FetchSampleManifest(context.Background(), "13370_1", args); err != nil {
+		t.Error("Fixture manifest not served: ", err)
+	}
+
+	args.LimsPW = "wrong"
+	if _, err := lims.FetchRequest(context.Background(), "13370", args); !errors.Is(err, types.ErrUnauthorized) {
+		t.Errorf("FetchRequest() error = %v, want %v", err, types.ErrUnauthorized)
+	}
+}
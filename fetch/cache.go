@@ -0,0 +1,150 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/metrics"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Response cache modes.
+const (
+	CacheUse     = "use"     // serve fresh entries, revalidate stale ones
+	CacheOnly    = "only"    // serve entries regardless of age, never call the service
+	CacheRefresh = "refresh" // always refetch and replace entries
+)
+
+// responseCache stores successful responses on disk, one file per endpoint
+// and URL.
+type responseCache struct {
+	dir       string
+	ttl       time.Duration
+	mode      string
+	endpoints map[string]bool
+}
+
+// cache is the response cache used by Get, nil when caching is disabled.
+var cache *responseCache
+
+// cacheEntry is the on-disk form of a cached response.
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Body         []byte    `json:"body"`
+}
+
+// EnableCache caches successful responses from the named endpoints in dir.
+// In CacheUse mode entries younger than ttl are served without calling the
+// service; older entries are revalidated with If-None-Match or
+// If-Modified-Since when the service returned an ETag or Last-Modified
+// header.  In CacheOnly mode a missing entry fails with types.ErrNotFound.
+func EnableCache(dir string, ttl time.Duration, mode string, endpoints ...string) error {
+	switch mode {
+	case CacheUse, CacheOnly, CacheRefresh:
+	default:
+		return fmt.Errorf("Invalid cache mode: %s", mode)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	c := &responseCache{dir: dir, ttl: ttl, mode: mode, endpoints: map[string]bool{}}
+	for _, e := range endpoints {
+		c.endpoints[e] = true
+	}
+	cache = c
+	return nil
+}
+
+// DisableCache stops Get from using the response cache.
+func DisableCache() {
+	cache = nil
+}
+
+func (c *responseCache) path(endpoint, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, endpoint, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *responseCache) load(path string, logger *slog.Logger) *cacheEntry {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		logger.Warn("Ignoring unreadable cache entry", "path", path, "error", err)
+		return nil
+	}
+	return e
+}
+
+func (c *responseCache) store(path string, e *cacheEntry, logger *slog.Logger) {
+	b, err := json.Marshal(e)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+			err = os.WriteFile(path, b, 0o600)
+		}
+	}
+	if err != nil {
+		logger.Warn("Unable to write cache entry", "path", path, "error", err)
+	}
+}
+
+func (c *responseCache) get(endpoint string, req *http.Request) ([]byte, error) {
+	url := req.URL.String()
+	path := c.path(endpoint, url)
+	logger := types.Logger(req.Context())
+	var e *cacheEntry
+	if c.mode != CacheRefresh {
+		e = c.load(path, logger)
+	}
+	if c.mode == CacheOnly {
+		if e == nil {
+			metrics.ObserveCache(endpoint, "miss")
+			return nil, &types.FetchError{Kind: types.ErrNotFound, URL: url, Err: errors.New("no cached response")}
+		}
+		metrics.ObserveCache(endpoint, "hit")
+		return e.Body, nil
+	}
+	if e != nil && time.Since(e.FetchedAt) < c.ttl {
+		metrics.ObserveCache(endpoint, "hit")
+		logger.Debug("Using cached response", "url", url, "age", time.Since(e.FetchedAt).Round(time.Second))
+		return e.Body, nil
+	}
+	if e != nil {
+		if e.ETag != "" {
+			req.Header.Set("If-None-Match", e.ETag)
+		}
+		if e.LastModified != "" {
+			req.Header.Set("If-Modified-Since", e.LastModified)
+		}
+	}
+
+	resp, err := do(endpoint, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status == http.StatusNotModified && e != nil {
+		metrics.ObserveCache(endpoint, "revalidated")
+		e.FetchedAt = time.Now()
+		c.store(path, e, logger)
+		return e.Body, nil
+	}
+	metrics.ObserveCache(endpoint, "miss")
+	if err := resp.err(req); err != nil {
+		return nil, err
+	}
+	c.store(path, &cacheEntry{URL: url, FetchedAt: time.Now(), ETag: resp.header.Get("ETag"),
+		LastModified: resp.header.Get("Last-Modified"), Body: resp.body}, logger)
+	return resp.body, nil
+}
@@ -0,0 +1,97 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetch_Cache(t *testing.T) {
+	var calls, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`[{"igoId":"13370_1"}]`))
+	}))
+	defer srv.Close()
+	defer DisableCache()
+	dir := t.TempDir()
+	get := func(url string) ([]byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		return Get("getSampleManifest", req)
+	}
+	url := srv.URL + "/LimsRest/api/getSampleManifest?igoSampleId=13370_1"
+
+	if err := EnableCache(dir, time.Hour, CacheUse, "getSampleManifest"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if body, err := get(url); err != nil || string(body) != `[{"igoId":"13370_1"}]` {
+			t.Fatalf("get() = %q, %v", body, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Fresh entry not served from cache, %d calls", calls)
+	}
+
+	// a stale entry is revalidated with its ETag
+	EnableCache(dir, 0, CacheUse, "getSampleManifest")
+	if body, err := get(url); err != nil || string(body) != `[{"igoId":"13370_1"}]` {
+		t.Fatalf("get() = %q, %v", body, err)
+	}
+	if calls != 2 || notModified != 1 {
+		t.Errorf("Stale entry not revalidated, %d calls, %d not modified", calls, notModified)
+	}
+
+	EnableCache(dir, 0, CacheRefresh, "getSampleManifest")
+	get(url)
+	if calls != 3 || notModified != 1 {
+		t.Errorf("Refresh did not refetch, %d calls, %d not modified", calls, notModified)
+	}
+
+	EnableCache(dir, 0, CacheOnly, "getSampleManifest")
+	if _, err := get(url); err != nil {
+		t.Error("Unexpected error serving cached entry offline: ", err)
+	}
+	if _, err := get(srv.URL + "/LimsRest/api/getSampleManifest?igoSampleId=13370_2"); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("get() error = %v, want %v", err, types.ErrNotFound)
+	}
+	if calls != 3 {
+		t.Errorf("Offline mode called the service, %d calls", calls)
+	}
+}
+
+func TestFetch_CacheLogsToContextLogger(t *testing.T) {
+	defer DisableCache()
+	if err := EnableCache(t.TempDir(), time.Hour, CacheOnly, "getSampleManifest"); err != nil {
+		t.Fatal(err)
+	}
+	url := "http://lims.invalid/LimsRest/api/getSampleManifest?igoSampleId=13370_1"
+	path := cache.path("getSampleManifest", url)
+	os.MkdirAll(filepath.Dir(path), 0o700)
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	ctx := types.WithLogger(context.Background(), slog.New(slog.NewTextHandler(&buf, nil)))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	Get("getSampleManifest", req)
+	if !strings.Contains(buf.String(), "Ignoring unreadable cache entry") {
+		t.Errorf("Unreadable cache entry not logged to the context logger, got %q", buf.String())
+	}
+}
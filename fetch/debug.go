@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// redactedHeaders are replaced with a placeholder before requests and
+// responses are dumped.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// debugTransport dumps every request/response pair to a file in dir.
+type debugTransport struct {
+	dir  string
+	next http.RoundTripper
+	seq  uint64
+}
+
+// EnableDebug dumps every subsequent request/response pair made through
+// HTTPClient into dir, with credentials redacted.
+func EnableDebug(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	next := HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	HTTPClient.Transport = &debugTransport{dir: dir, next: next}
+	return nil
+}
+
+// redact returns a copy of h with the redactedHeaders replaced.
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, "REDACTED")
+		}
+	}
+	return h
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var buf bytes.Buffer
+	clone := req.Clone(req.Context())
+	clone.Header = redact(req.Header)
+	if dump, err := httputil.DumpRequestOut(clone, false); err == nil {
+		buf.Write(dump)
+	}
+	buf.WriteString("\n")
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(&buf, "error: %s\n", err)
+	} else {
+		// dump the response with redacted headers, handing the caller the
+		// original ones
+		header := resp.Header
+		resp.Header = redact(header)
+		if dump, derr := httputil.DumpResponse(resp, true); derr == nil {
+			buf.Write(dump)
+		}
+		resp.Header = header
+	}
+
+	n := atomic.AddUint64(&t.seq, 1)
+	name := fmt.Sprintf("%s-%04d-%s.http", time.Now().Format("20060102T150405"), n, path.Base(req.URL.Path))
+	file := filepath.Join(t.dir, name)
+	if werr := os.WriteFile(file, buf.Bytes(), 0o600); werr != nil {
+		types.Logger(req.Context()).Warn("Unable to write HTTP debug dump", "path", file, "error", werr)
+	}
+	return resp, err
+}
@@ -0,0 +1,102 @@
+package fetch
+
+import (
+	"encoding/json"
+	"github.com/mskcc/smile-message-publisher-go/metrics"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"time"
+)
+
+var tracer = otel.Tracer("github.com/mskcc/smile-message-publisher-go/fetch")
+
+// HTTPClient is used for every fetch made by this package.
+var HTTPClient = &http.Client{}
+
+// Get performs req and returns the response body.  Failures are reported
+// as a *types.FetchError classified by cause.  endpoint names the API being
+// called in metrics, and selects whether the response cache is used.
+func Get(endpoint string, req *http.Request) ([]byte, error) {
+	if c := cache; c != nil && c.endpoints[endpoint] {
+		return c.get(endpoint, req)
+	}
+	resp, err := do(endpoint, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.body, resp.err(req)
+}
+
+// response is a completed HTTP exchange.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// err returns a *types.FetchError unless the response was successful.
+func (r *response) err(req *http.Request) error {
+	if r.status != http.StatusOK {
+		return types.NewStatusError(req.URL.String(), r.status, r.body)
+	}
+	return nil
+}
+
+// do performs req, once any rate limiter attached to its context allows
+// and within any call timeout attached to it, tracing and recording metrics
+// for it.  Only failures to get a response are returned as errors.
+func do(endpoint string, req *http.Request) (*response, error) {
+	ctx, cancel, err := callContext(req.Context())
+	defer cancel()
+	if err != nil {
+		return nil, err
+	}
+	url := req.URL.String()
+	ctx, span := tracer.Start(ctx, "GET "+endpoint, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", url)))
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		metrics.ObserveHTTP(endpoint, 0, time.Since(start))
+		recordHealth(endpoint, 0, time.Now())
+		types.Logger(ctx).Debug("HTTP request failed", "url", url, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+		return nil, types.NewTransportError(url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	metrics.ObserveHTTP(endpoint, resp.StatusCode, time.Since(start))
+	recordHealth(endpoint, resp.StatusCode, time.Now())
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	types.Logger(ctx).Debug("HTTP request completed", "url", url, "status", resp.StatusCode, "bytes", len(body),
+		"duration_ms", time.Since(start).Milliseconds())
+	if err != nil {
+		return nil, types.NewTransportError(url, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return &response{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// GetJSON performs req and unmarshals the JSON response body into v.
+func GetJSON(endpoint string, req *http.Request, v interface{}) error {
+	body, err := Get(endpoint, req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return types.NewDecodeError(req.URL.String(), body, err)
+	}
+	return nil
+}
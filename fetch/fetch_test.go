@@ -0,0 +1,156 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"golang.org/x/time/rate"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetch_GetJSONErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		want      error
+		retryable bool
+	}{
+		{"not found", http.StatusNotFound, "no such request", types.ErrNotFound, false},
+		{"unauthorized", http.StatusUnauthorized, "bad credentials", types.ErrUnauthorized, false},
+		{"gateway timeout", http.StatusGatewayTimeout, "", types.ErrTimeout, true},
+		{"decode", http.StatusOK, "{not json", types.ErrDecode, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v map[string]interface{}
+			err = GetJSON("test", req, &v)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, err)
+			}
+			var fe *types.FetchError
+			if !errors.As(err, &fe) {
+				t.Fatalf("expected *types.FetchError, got %T", err)
+			}
+			if fe.StatusCode != tc.status || fe.URL != srv.URL || fe.Body != tc.body {
+				t.Errorf("unexpected error fields: %+v", fe)
+			}
+			if types.Retryable(err) != tc.retryable {
+				t.Errorf("expected retryable %v for %v", tc.retryable, err)
+			}
+		})
+	}
+}
+
+func TestFetch_GetBodySnippet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(strings.Repeat("x", 2*types.MaxBodySnippet)))
+	}))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Get("test", req)
+	var fe *types.FetchError
+	if !errors.As(err, &fe) {
+		t.Fatalf("expected *types.FetchError, got %T", err)
+	}
+	if len(fe.Body) != types.MaxBodySnippet+len("...") {
+		t.Errorf("expected truncated body, got %d bytes", len(fe.Body))
+	}
+	if !types.Retryable(err) {
+		t.Error("expected server error to be retryable")
+	}
+}
+
+func TestFetch_EnableDebugRedactsAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "c2Vzc2lvbg"})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing igoSampleId"))
+	}))
+	defer srv.Close()
+	saved := HTTPClient
+	HTTPClient = &http.Client{}
+	defer func() { HTTPClient = saved }()
+	dir := t.TempDir()
+	if err := EnableDebug(dir); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/LimsRest/api/getSampleManifest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	if _, err = Get("test", req); err == nil {
+		t.Fatal("expected error for 400 response")
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*-getSampleManifest.http"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one dump file, got %v (%v)", files, err)
+	}
+	dump, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dump), "c2VjcmV0") || !strings.Contains(string(dump), "Authorization: REDACTED") {
+		t.Errorf("authorization header not redacted:\n%s", dump)
+	}
+	if strings.Contains(string(dump), "c2Vzc2lvbg") || !strings.Contains(string(dump), "Set-Cookie: REDACTED") {
+		t.Errorf("response cookie not redacted:\n%s", dump)
+	}
+	if !strings.Contains(string(dump), "missing igoSampleId") {
+		t.Errorf("response body not dumped:\n%s", dump)
+	}
+}
+
+func TestFetch_WaitRateLimit(t *testing.T) {
+	l := rate.NewLimiter(Limit(1), 1)
+	if err := Wait(context.Background(), l, "test"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	// the next token is a second away, beyond the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Wait(ctx, l, "test"); !errors.Is(err, types.ErrTimeout) {
+		t.Errorf("Wait() = %v, want %v", err, types.ErrTimeout)
+	}
+	if Limit(0) != rate.Inf {
+		t.Errorf("Limit(0) = %v, want unlimited", Limit(0))
+	}
+}
+
+func TestFetch_CallTimeoutStartsAfterRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	l := rate.NewLimiter(Limit(10), 1)
+	l.Allow()
+	// the next token is 100ms away, longer than the call timeout
+	ctx := WithCallTimeout(WithLimiter(context.Background(), l, "test"), 50*time.Millisecond)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get("test", req); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package fetch
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// endpointHealth tracks whether calls to one endpoint are succeeding.
+type endpointHealth struct {
+	lastSuccess  time.Time
+	failingSince time.Time // first failure since lastSuccess, zero if none
+}
+
+var health = struct {
+	sync.Mutex
+	endpoints map[string]*endpointHealth
+}{endpoints: map[string]*endpointHealth{}}
+
+// recordHealth records the outcome of a call to endpoint.  A call fails if
+// no response was received, the credentials were rejected or the service
+// returned a server error; other responses show the service is reachable.
+func recordHealth(endpoint string, status int, at time.Time) {
+	ok := status != 0 && status < 500 && status != http.StatusUnauthorized && status != http.StatusForbidden
+	health.Lock()
+	defer health.Unlock()
+	h := health.endpoints[endpoint]
+	if h == nil {
+		h = &endpointHealth{}
+		health.endpoints[endpoint] = h
+	}
+	if ok {
+		h.lastSuccess = at
+		h.failingSince = time.Time{}
+	} else if h.failingSince.IsZero() {
+		h.failingSince = at
+	}
+}
+
+// Health reports, across endpoints, when a call last succeeded and, if
+// calls have failed since, when they started failing.  Both are zero until
+// the endpoints are called.
+func Health(endpoints ...string) (lastSuccess, failingSince time.Time) {
+	health.Lock()
+	defer health.Unlock()
+	for _, e := range endpoints {
+		if h := health.endpoints[e]; h != nil && h.lastSuccess.After(lastSuccess) {
+			lastSuccess = h.lastSuccess
+		}
+	}
+	for _, e := range endpoints {
+		h := health.endpoints[e]
+		if h == nil || h.failingSince.IsZero() || h.failingSince.Before(lastSuccess) {
+			continue
+		}
+		if failingSince.IsZero() || h.failingSince.Before(failingSince) {
+			failingSince = h.failingSince
+		}
+	}
+	return lastSuccess, failingSince
+}
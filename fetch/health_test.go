@@ -0,0 +1,24 @@
+package fetch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFetch_Health(t *testing.T) {
+	t0 := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	recordHealth("testRequests", 200, t0)
+	recordHealth("testManifests", 404, t0.Add(time.Minute))
+	if ls, fs := Health("testRequests", "testManifests"); !ls.Equal(t0.Add(time.Minute)) || !fs.IsZero() {
+		t.Errorf("Health() = %s, %s after successes", ls, fs)
+	}
+	recordHealth("testManifests", 0, t0.Add(2*time.Minute))
+	recordHealth("testRequests", 503, t0.Add(3*time.Minute))
+	if ls, fs := Health("testRequests", "testManifests"); !ls.Equal(t0.Add(time.Minute)) || !fs.Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("Health() = %s, %s after failures", ls, fs)
+	}
+	recordHealth("testRequests", 200, t0.Add(4*time.Minute))
+	if _, fs := Health("testRequests", "testManifests"); !fs.IsZero() {
+		t.Errorf("Still failing since %s after a later success", fs)
+	}
+}
@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// Limit converts a rate in requests per second to a rate.Limit, treating
+// zero as unlimited.
+func Limit(rps float64) rate.Limit {
+	if rps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(rps)
+}
+
+// Wait blocks until l permits a call to service or ctx is done.  A wait that
+// could not finish before the deadline of ctx is reported as ErrTimeout.
+func Wait(ctx context.Context, l *rate.Limiter, service string) error {
+	if err := l.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		return fmt.Errorf("%w: waiting for %s rate limit: %s", types.ErrTimeout, service, err)
+	}
+	return nil
+}
+
+type limiterKey struct{}
+
+type limiterValue struct {
+	l       *rate.Limiter
+	service string
+}
+
+// WithLimiter returns a copy of ctx whose requests wait for l before each
+// call to service.  Responses served from the cache do not wait.
+func WithLimiter(ctx context.Context, l *rate.Limiter, service string) context.Context {
+	return context.WithValue(ctx, limiterKey{}, limiterValue{l: l, service: service})
+}
+
+// waitLimiter waits for the limiter attached to ctx with WithLimiter, if any.
+func waitLimiter(ctx context.Context) error {
+	if lv, ok := ctx.Value(limiterKey{}).(limiterValue); ok {
+		return Wait(ctx, lv.l, lv.service)
+	}
+	return nil
+}
+
+type callTimeoutKey struct{}
+
+// WithCallTimeout returns a copy of ctx whose requests are each bounded by
+// d, counted from when any limiter attached with WithLimiter permits the
+// call, so time queued for the limiter does not count against it.
+func WithCallTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, callTimeoutKey{}, d)
+}
+
+// callContext waits for the limiter attached to ctx, if any, then returns
+// ctx bounded by its call timeout, if any.
+func callContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	if err := waitLimiter(ctx); err != nil {
+		return ctx, func() {}, err
+	}
+	if d, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		return ctx, cancel, nil
+	}
+	return ctx, func() {}, nil
+}
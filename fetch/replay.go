@@ -0,0 +1,67 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ReplayTransport serves LimsRest and SMILE request service calls from JSON
+// fixtures instead of the network, in the layout written by the
+// record-fixtures command:
+//
+//	<LimsDir>/<requestId>.json  getRequestSamples?request=<requestId>
+//	<LimsDir>/<sampleId>.json   getSampleManifest?igoSampleId=<sampleId>
+//	<SmileDir>/<requestId>.json <smile request url><requestId>
+//
+// Calls without a fixture get a 404 response.
+type ReplayTransport struct {
+	LimsDir  string
+	SmileDir string
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	q := req.URL.Query()
+	var file string
+	var list bool
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/LimsRest/api/getRequestSamples"):
+		file = filepath.Join(t.LimsDir, q.Get("request")+".json")
+	case strings.HasSuffix(req.URL.Path, "/LimsRest/api/getSampleManifest"):
+		// the service returns a list holding the one manifest
+		file = filepath.Join(t.LimsDir, q.Get("igoSampleId")+".json")
+		list = true
+	case strings.Contains(req.URL.Path, "/LimsRest/"):
+	default:
+		file = filepath.Join(t.SmileDir, path.Base(req.URL.Path)+".json")
+	}
+	body, err := os.ReadFile(file)
+	if file == "" || err != nil {
+		return replayResponse(req, http.StatusNotFound, []byte("no fixture for "+req.URL.String())), nil
+	}
+	if list {
+		body = append(append([]byte("["), body...), ']')
+	}
+	return replayResponse(req, http.StatusOK, body), nil
+}
+
+func replayResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/lims"
+	"github.com/mskcc/smile-message-publisher-go/smile"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/viper"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// phiKeys are the response properties identifying patients or people,
+// replaced when recording fixtures with --strip_phi.
+var phiKeys = map[string]bool{
+	"cmoPatientId":         true,
+	"patientId":            true,
+	"dmpPatientId":         true,
+	"cmoSampleName":        true,
+	"sampleName":           true,
+	"investigatorSampleId": true,
+	"investigatorName":     true,
+	"investigatorEmail":    true,
+	"labHeadName":          true,
+	"labHeadEmail":         true,
+	"piEmail":              true,
+	"projectManagerName":   true,
+	"dataAnalystName":      true,
+	"dataAnalystEmail":     true,
+	"otherContactEmails":   true,
+	"dataAccessEmails":     true,
+	"qcAccessEmails":       true,
+}
+
+// sanitize replaces secret and, if stripPHI, PHI string properties in a
+// decoded JSON value.  JSON objects embedded in strings, as SMILE keeps the
+// original LIMS response, are sanitized too.
+func sanitize(v interface{}, stripPHI bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if s, ok := val.(string); ok && s != "" && (isSecret(strings.ToLower(k)) || (stripPHI && phiKeys[k])) {
+				v[k] = "REDACTED"
+				continue
+			}
+			v[k] = sanitize(val, stripPHI)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = sanitize(v[i], stripPHI)
+		}
+	case string:
+		if strings.HasPrefix(v, "{") {
+			if inner, err := decodeJSON([]byte(v)); err == nil {
+				if b, err := json.Marshal(sanitize(inner, stripPHI)); err == nil {
+					return string(b)
+				}
+			}
+		}
+	}
+	return v
+}
+
+// decodeJSON decodes b keeping numbers, such as millisecond timestamps,
+// exactly as given.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// writeFixture writes v, sanitized, as indented JSON to dir/<name>.json.
+func writeFixture(dir, name string, v interface{}, stripPHI bool) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeJSON(b)
+	if err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(sanitize(decoded, stripPHI), "", "    "); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name+".json")
+	if err = os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	slog.Info("Wrote fixture", "path", path)
+	return nil
+}
+
+func splitIds(ids string) []string {
+	if ids == "" {
+		return nil
+	}
+	return strings.Split(ids, ",")
+}
+
+// recordFixtures implements the record-fixtures command.  Each request given
+// with --request_ids is fetched from LimsRest with its sample manifests, and
+// each given with --smile_service from the SMILE request service; the
+// sanitized responses are written to lims/testdata and smile/testdata under
+// --fixtures_dir, where fetch.ReplayTransport serves them back in tests.
+func recordFixtures() error {
+	args, err := parseArgs()
+	if err != nil {
+		slog.Error("Error parsing arguments", "error", err)
+		return err
+	}
+	limsIds := splitIds(viper.GetString("request_ids"))
+	smileIds := splitIds(viper.GetString("smile_service"))
+	if len(limsIds) == 0 && len(smileIds) == 0 {
+		err = fmt.Errorf("record-fixtures needs request_ids and/or smile_service")
+		slog.Error("Error parsing arguments", "error", err)
+		return err
+	}
+	if err = setupFetch(args); err != nil {
+		return err
+	}
+	ctx, cancel := rootContext(args)
+	defer cancel()
+	stripPHI := viper.GetBool("strip_phi")
+	root := viper.GetString("fixtures_dir")
+
+	limsDir := filepath.Join(root, "lims", "testdata")
+	for _, id := range limsIds {
+		if err := types.Stopping(ctx); err != nil {
+			return err
+		}
+		req, err := lims.FetchRequest(ctx, id, args)
+		if err != nil {
+			return fmt.Errorf("request %s: %w", id, err)
+		}
+		if err = writeFixture(limsDir, id, req, stripPHI); err != nil {
+			return err
+		}
+		for _, s := range req.GetSamples() {
+			man, err := lims.FetchSampleManifest(ctx, s.IgoSampleId, args)
+			if err != nil {
+				return fmt.Errorf("sample %s: %w", s.IgoSampleId, err)
+			}
+			if err = writeFixture(limsDir, s.IgoSampleId, man, stripPHI); err != nil {
+				return err
+			}
+		}
+	}
+	smileDir := filepath.Join(root, "smile", "testdata")
+	for _, id := range smileIds {
+		if err := types.Stopping(ctx); err != nil {
+			return err
+		}
+		rwm, err := smile.FetchRequest(ctx, id, args)
+		if err != nil {
+			return fmt.Errorf("request %s: %w", id, err)
+		}
+		if err = writeFixture(smileDir, id, rwm, stripPHI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/fakelims"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixtures_writeFixtureSanitizes(t *testing.T) {
+	v := map[string]interface{}{
+		"requestId":          "05274_C",
+		"labHeadEmail":       "head@example.org",
+		"deliveryDate":       int64(1656516287010),
+		"apiToken":           "t0ken",
+		"dataAnalystName":    "",
+		"requestJson":        `{"investigatorName":"A Person","requestId":"05274_C"}`,
+		"samples":            []map[string]string{{"cmoPatientId": "C-123456", "igoId": "05274_C_1"}},
+		"isCmoRequest":       true,
+		"otherContactEmails": "a@example.org,b@example.org",
+	}
+	dir := t.TempDir()
+	if err := writeFixture(dir, "05274_C", v, true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "05274_C.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, leaked := range []string{"head@example.org", "t0ken", "A Person", "C-123456", "a@example.org"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("Fixture contains %q:\n%s", leaked, out)
+		}
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["requestId"] != "05274_C" || got["dataAnalystName"] != "" || !strings.Contains(out, "1656516287010") {
+		t.Errorf("Fixture lost non-PHI content:\n%s", out)
+	}
+}
+
+func TestFixtures_recordWithoutNatsConfig(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	fl := fakelims.New("fake", "fake")
+	if err := fl.LoadDir(filepath.Join("lims", "testdata")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(fl)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lims", "testdata"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(dir, "conf.yaml")
+	content := "lims:\n  host: " + strings.TrimPrefix(srv.URL, "http://") +
+		"\n  scheme: http\n  username: fake\n  password: fake\n"
+	if err := os.WriteFile(cf, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pflag.CommandLine.Parse([]string{"record-fixtures"})
+	defer pflag.CommandLine.Parse(nil)
+	viper.Set("cfg_file", cf)
+	viper.Set("request_ids", "13370")
+	viper.Set("fixtures_dir", dir)
+
+	// the fixtures hold only the first sample of 13370, so the others are
+	// not found
+	if err := recordFixtures(); err != nil && !errors.Is(err, types.ErrNotFound) {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"13370.json", "13370_1.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "lims", "testdata", f)); err != nil {
+			t.Errorf("Fixture not written: %s", err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package lims
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Stages of fetchAndPublishRequest a request can fail at.
+const (
+	StageFetch     = "fetch"
+	StageSerialize = "serialize"
+	StagePublish   = "publish"
+)
+
+// DeadLetter is an entry of the dead-letter file, describing a request, or
+// a single sample, that could not be fetched or published.
+type DeadLetter struct {
+	RequestId string    `json:"requestId"`
+	SampleId  string    `json:"sampleId,omitempty"` // set for a sample published on its own
+	Mode      string    `json:"mode"`
+	Stage     string    `json:"stage"` // one of the Stage constants
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+	Topic     string    `json:"topic,omitempty"`
+	Payload   []byte    `json:"payload,omitempty"`   // serialized RequestWithManifests, if it got that far
+	Permanent bool      `json:"permanent,omitempty"` // not worth retrying, see types.Retryable
+}
+
+// stageError records the stage a request failed at, and its serialized
+// payload once available, for the dead-letter file.
+type stageError struct {
+	stage   string
+	topic   string
+	payload []byte
+	err     error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// deadLetterMu serializes writes to dead-letter files by concurrent runs of
+// this process; lockDeadLetters also excludes other processes.
+var deadLetterMu sync.Mutex
+
+// lockDeadLetters locks the dead-letter file at path against writes by
+// other runs and processes, through the lock file path.lock, and returns
+// the function releasing the lock.
+func lockDeadLetters(path string) (func(), error) {
+	deadLetterMu.Lock()
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		deadLetterMu.Unlock()
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		deadLetterMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		deadLetterMu.Unlock()
+	}, nil
+}
+
+// key identifies the request or sample dl is about.
+func (dl DeadLetter) key() string {
+	if dl.SampleId != "" {
+		return "sample " + dl.SampleId
+	}
+	return "request " + dl.RequestId
+}
+
+// newDeadLetter describes the failure err of request id.
+func newDeadLetter(id string, err error, args types.Arguments) DeadLetter {
+	dl := DeadLetter{RequestId: id, Mode: args.Mode(), Stage: StageFetch, Error: err.Error(), Time: time.Now().UTC(),
+		Permanent: !types.Retryable(err)}
+	var se *stageError
+	if errors.As(err, &se) {
+		dl.Stage, dl.Topic, dl.Payload = se.stage, se.topic, se.payload
+	}
+	return dl
+}
+
+// appendDeadLetter appends dl to the dead-letter file at path.
+func appendDeadLetter(path string, dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDeadLetters(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// recordFailure appends the failure err of request id to the dead-letter
+// file, if one is configured and the request was not interrupted.
+func recordFailure(id string, err error, args types.Arguments, rl *slog.Logger) {
+	recordDeadLetter(newDeadLetter(id, err, args), err, args, rl)
+}
+
+// recordSampleFailure appends the failure err of sample sId, published on
+// its own, to the dead-letter file, as recordFailure does.
+func recordSampleFailure(sId string, err error, args types.Arguments, rl *slog.Logger) {
+	reqId, _ := sampleRequestId(sId)
+	dl := newDeadLetter(reqId, err, args)
+	dl.SampleId = sId
+	recordDeadLetter(dl, err, args, rl)
+}
+
+func recordDeadLetter(dl DeadLetter, err error, args types.Arguments, rl *slog.Logger) {
+	// an interrupted request did not fail, it is left to --resume
+	if args.DeadLetterPath == "" || errors.Is(err, types.ErrInterrupted) || errors.Is(err, context.Canceled) {
+		return
+	}
+	if derr := appendDeadLetter(args.DeadLetterPath, dl); derr != nil {
+		rl.Error("Failure to write dead-letter file", "path", args.DeadLetterPath, "error", derr)
+	}
+}
+
+// ReadDeadLetters reads the entries of the dead-letter file at path.  A
+// missing file has no entries.
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var dls []DeadLetter
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 64<<20)
+	for ln := 1; sc.Scan(); ln++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w: %s", path, ln, types.ErrDecode, err)
+		}
+		dls = append(dls, dl)
+	}
+	return dls, sc.Err()
+}
+
+// rewriteDeadLetters replaces the first n entries of the dead-letter file
+// at path, those read before retrying, with dls, keeping any entries
+// appended since.
+func rewriteDeadLetters(path string, n int, dls []DeadLetter) error {
+	unlock, err := lockDeadLetters(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := ReadDeadLetters(path)
+	if err != nil {
+		return err
+	}
+	if len(current) > n {
+		dls = append(dls, current[n:]...)
+	}
+	return writeDeadLetters(path, dls)
+}
+
+// writeDeadLetters replaces the dead-letter file at path with dls.  The
+// caller must hold the lock from lockDeadLetters.
+func writeDeadLetters(path string, dls []DeadLetter) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, dl := range dls {
+		if err := enc.Encode(dl); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RetryDeadLetters retries each request or sample in the dead-letter file
+// at args.DeadLetterPath, removing those that now succeed.  A request failing
+// more than once is retried once, from its latest entry: its payload is
+// republished to the recorded topic if it failed publishing, otherwise it
+// is fetched again.  Requests still failing are left with a single, updated
+// entry.  Requests whose latest failure is permanent are not retried, and
+// are left with their latest entry.  Entries appended while retrying, e.g.
+// by a serve process, are kept.
+func RetryDeadLetters(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	logger := types.Logger(ctx).With("mode", args.Mode(), "file", args.DeadLetterPath)
+	unlock, err := lockDeadLetters(args.DeadLetterPath)
+	if err != nil {
+		return err
+	}
+	dls, err := ReadDeadLetters(args.DeadLetterPath)
+	unlock()
+	if err != nil {
+		return err
+	}
+	latest := map[string]DeadLetter{}
+	var ids []string
+	for _, dl := range dls {
+		if _, ok := latest[dl.key()]; !ok {
+			ids = append(ids, dl.key())
+		}
+		latest[dl.key()] = dl
+	}
+	logger.Info("Retrying failed request(s)", "entries", len(dls), "requests", len(ids))
+
+	var remaining []DeadLetter
+	var errs []error
+	permanent := 0
+	for i, id := range ids {
+		dl := latest[id]
+		if dl.Permanent {
+			logger.Warn("Skipping request that failed permanently", "request_id", dl.RequestId, "sample_id", dl.SampleId,
+				"stage", dl.Stage, "error", dl.Error)
+			remaining = append(remaining, dl)
+			permanent++
+			continue
+		}
+		if err := types.Stopping(ctx); err != nil {
+			logger.Warn("Stopping before remaining request(s)", "remaining", len(ids)-i, "reason", err)
+			errs = append(errs, fmt.Errorf("%d request(s) not attempted: %w", len(ids)-i, err))
+			for _, id := range ids[i:] {
+				remaining = append(remaining, latest[id])
+			}
+			break
+		}
+		rl := logger.With("request_id", dl.RequestId, "stage", dl.Stage)
+		if dl.SampleId != "" {
+			rl = rl.With("sample_id", dl.SampleId)
+		}
+		rl.Info("Attempting to retry request", "index", i+1, "total", len(ids))
+		if err := retryDeadLetter(ctx, m, dl, args, rl); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			ndl := newDeadLetter(dl.RequestId, err, args)
+			ndl.SampleId, ndl.Mode = dl.SampleId, dl.Mode
+			remaining = append(remaining, ndl)
+			continue
+		}
+		rl.Info("Successfully retried request")
+	}
+	if werr := rewriteDeadLetters(args.DeadLetterPath, len(dls), remaining); werr != nil {
+		logger.Error("Failure to rewrite dead-letter file", "error", werr)
+		errs = append(errs, werr)
+	}
+	if permanent > 0 {
+		logger.Warn("Permanently failed request(s) not retried", "requests", permanent)
+	}
+	types.LogSummary(logger, "request(s)", len(ids)-permanent, errs)
+	return errors.Join(errs...)
+}
+
+func retryDeadLetter(ctx context.Context, m *messaging.Messaging, dl DeadLetter, args types.Arguments, rl *slog.Logger) error {
+	if dl.Stage != StagePublish || len(dl.Payload) == 0 {
+		if dl.SampleId == "" {
+			return fetchAndPublishRequest(ctx, m, dl.RequestId, args, rl)
+		}
+		if args.LimsSampleTop == "" {
+			args.LimsSampleTop = dl.Topic
+		}
+		return fetchAndPublishSample(ctx, m, dl.SampleId, map[string]*igo.Request{}, args, rl)
+	}
+	md := messaging.Metadata{Source: messaging.SourceLims, RequestId: dl.RequestId, SampleId: dl.SampleId, RunId: args.RunId,
+		Type: string(proto.MessageName(&igo.RequestWithManifests{})), FetchedAt: dl.Time}
+	if dl.SampleId != "" {
+		md.Type = string(proto.MessageName(&igo.SampleManifest{}))
+	}
+	if err := m.PublishContext(ctx, dl.Topic, dl.Payload, md); err != nil {
+		rl.Error("Failure to republish payload", "topic", dl.Topic, "error", err)
+		return &stageError{stage: StagePublish, topic: dl.Topic, payload: dl.Payload, err: err}
+	}
+	return nil
+}
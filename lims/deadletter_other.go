@@ -0,0 +1,17 @@
+//go:build !unix
+
+package lims
+
+import (
+	"os"
+)
+
+// lockFile is a no-op where advisory file locks are unavailable; writes are
+// then only serialized within the process.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
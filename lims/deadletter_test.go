@@ -0,0 +1,121 @@
+package lims
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter_RecordAndRetryFetchFailures(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	fetch.HTTPClient.Transport = &fetch.ReplayTransport{LimsDir: "testdata"}
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	args := types.Arguments{LimsHost: "igolims.example.org:8443", ReqIdMode: true, DeadLetterPath: path}
+
+	// no request 99999 is recorded in testdata, so it fails fetching twice
+	err := FetchRequests(context.Background(), nil, []string{"99999", "99999"}, args)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	dls, err := ReadDeadLetters(path)
+	if err != nil || len(dls) != 2 {
+		t.Fatalf("Expected 2 entries, got %v %v", dls, err)
+	}
+	if dl := dls[0]; dl.RequestId != "99999" || dl.Mode != "request_ids" || dl.Stage != StageFetch || dl.Error == "" || dl.Payload != nil || !dl.Permanent {
+		t.Errorf("Unexpected entry: %+v", dl)
+	}
+
+	// a request that is not found is not retried, and keeps its latest entry
+	args.ReqIdMode, args.RetryMode = false, true
+	if err = RetryDeadLetters(context.Background(), nil, args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	retried, err := ReadDeadLetters(path)
+	if err != nil || len(retried) != 1 || !retried[0].Time.Equal(dls[1].Time) {
+		t.Fatalf("Expected the latest entry left, got %v %v", retried, err)
+	}
+
+	// a transient failure is retried, and replaced by an updated entry
+	dls[1].Permanent = false
+	if err = writeDeadLetters(path, dls[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = RetryDeadLetters(context.Background(), nil, args); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	retried, err = ReadDeadLetters(path)
+	if err != nil || len(retried) != 1 {
+		t.Fatalf("Expected 1 entry left, got %v %v", retried, err)
+	}
+	if dl := retried[0]; dl.RequestId != "99999" || dl.Mode != "request_ids" || dl.Time.Before(dls[1].Time) || !dl.Permanent {
+		t.Errorf("Unexpected entry: %+v", dl)
+	}
+}
+
+func TestDeadLetter_RetryKeepsEntriesWhenStopped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	want := []DeadLetter{
+		{RequestId: "1", Stage: StagePublish, Topic: "t", Payload: []byte{1, 2}, Time: time.Now().UTC()},
+		{RequestId: "2", Stage: StageFetch, Time: time.Now().UTC()},
+	}
+	if err := writeDeadLetters(path, want); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	ctx := types.WithStop(context.Background(), stop)
+	if err := RetryDeadLetters(ctx, nil, types.Arguments{RetryMode: true, DeadLetterPath: path}); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("Expected interrupted, got %v", err)
+	}
+	got, err := ReadDeadLetters(path)
+	if err != nil || len(got) != 2 || string(got[0].Payload) != string(want[0].Payload) || got[1].RequestId != "2" {
+		t.Errorf("Unexpected entries: %+v %v", got, err)
+	}
+}
+
+// appendingTransport appends a dead-letter entry on each call, as a serve
+// process writing to the same file would, then replays from testdata.
+type appendingTransport struct {
+	path string
+}
+
+func (t *appendingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := appendDeadLetter(t.path, DeadLetter{RequestId: "88888", Stage: StageFetch, Time: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+	return (&fetch.ReplayTransport{LimsDir: "testdata"}).RoundTrip(req)
+}
+
+func TestDeadLetter_RetryKeepsEntriesAppendedMeanwhile(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	fetch.HTTPClient.Transport = &appendingTransport{path: path}
+	if err := writeDeadLetters(path, []DeadLetter{{RequestId: "99999", Stage: StageFetch, Time: time.Now().UTC()}}); err != nil {
+		t.Fatal(err)
+	}
+	args := types.Arguments{LimsHost: "igolims.example.org:8443", RetryMode: true, DeadLetterPath: path}
+	if err := RetryDeadLetters(context.Background(), nil, args); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	got, err := ReadDeadLetters(path)
+	if err != nil || len(got) != 2 || got[0].RequestId != "99999" || got[1].RequestId != "88888" {
+		t.Errorf("Unexpected entries: %+v %v", got, err)
+	}
+}
+
+func TestDeadLetter_InterruptedRequestsAreNotRecorded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	args := types.Arguments{DeadLetterPath: path}
+	recordFailure("13370", fmt.Errorf("fetching samples: %w", ErrInterrupted), args, slog.Default())
+	recordFailure("13371", context.Canceled, args, slog.Default())
+	if dls, err := ReadDeadLetters(path); err != nil || len(dls) != 0 {
+		t.Errorf("Unexpected entries: %+v %v", dls, err)
+	}
+}
@@ -0,0 +1,33 @@
+package lims
+
+import (
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/types"
+)
+
+// Error classes returned by this package, see the types package for details.
+var (
+	ErrNotFound     = types.ErrNotFound
+	ErrUnauthorized = types.ErrUnauthorized
+	ErrTimeout      = types.ErrTimeout
+	ErrDecode       = types.ErrDecode
+	ErrPublish      = types.ErrPublish
+	ErrInterrupted  = types.ErrInterrupted
+)
+
+type FetchError = types.FetchError
+type PublishError = types.PublishError
+
+// SampleError describes a sample manifest that could not be fetched.
+type SampleError struct {
+	SampleId string
+	Err      error
+}
+
+func (e *SampleError) Error() string {
+	return fmt.Sprintf("sample %s: %s", e.SampleId, e.Err)
+}
+
+func (e *SampleError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,170 @@
+package lims
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Journal is the progress of a run of FetchRequests, as recorded in
+// <dir>/<run id>.jsonl: a header line with the requests the run started
+// with, followed by a line for each request attempted.
+type Journal struct {
+	RunId      string    `json:"runId"`
+	Mode       string    `json:"mode"`
+	CMOReqs    bool      `json:"cmoRequestsOnly"`
+	RequestIds []string  `json:"requestIds"`
+	StartedAt  time.Time `json:"startedAt"`
+
+	// Done holds the requests published, or skipped by the CMO filter.
+	Done map[string]bool `json:"-"`
+}
+
+// journalEntry records the outcome of one request.
+type journalEntry struct {
+	RequestId string    `json:"requestId"`
+	Done      bool      `json:"done"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// journalPath returns the path of the journal of run runId.
+func journalPath(dir, runId string) string {
+	return filepath.Join(dir, runId+".jsonl")
+}
+
+// journalWriter appends to the journal of a run.
+type journalWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openJournal opens the journal of args.RunId for appending, starting it
+// with reqIds unless it already exists, as when resuming.
+func openJournal(reqIds []string, args types.Arguments) (*journalWriter, error) {
+	if err := os.MkdirAll(args.JournalDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(journalPath(args.JournalDir, args.RunId), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	jw := &journalWriter{f: f, enc: json.NewEncoder(f)}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() > 0 {
+		// end an entry cut short by a crash, so the next is not lost with it
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			_, err = f.Write([]byte{'\n'})
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return jw, nil
+	}
+	hdr := Journal{RunId: args.RunId, Mode: args.Mode(), CMOReqs: args.CMOReqs, RequestIds: reqIds, StartedAt: time.Now().UTC()}
+	if err = jw.enc.Encode(hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return jw, nil
+}
+
+// record appends the outcome err of request id to the journal.
+func (jw *journalWriter) record(id string, err error) error {
+	e := journalEntry{RequestId: id, Done: err == nil, Time: time.Now().UTC()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return jw.enc.Encode(e)
+}
+
+func (jw *journalWriter) close() error {
+	return jw.f.Close()
+}
+
+// finishJournal closes the journal of run args.RunId, removing it if done,
+// when no request is left to resume.
+func finishJournal(jw *journalWriter, done bool, args types.Arguments, logger *slog.Logger) {
+	path := journalPath(args.JournalDir, args.RunId)
+	if err := jw.close(); err != nil {
+		logger.Error("Failure to close journal", "path", path, "error", err)
+	}
+	if !done {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Error("Failure to remove journal of finished run", "path", path, "error", err)
+		return
+	}
+	logger.Info("Removed journal of finished run", "path", path)
+}
+
+// ReadJournal reads the journal of run runId from dir.
+func ReadJournal(dir, runId string) (*Journal, error) {
+	path := journalPath(dir, runId)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("No journal for run %s in %s", runId, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	j := &Journal{Done: map[string]bool{}}
+	if !sc.Scan() {
+		return nil, fmt.Errorf("%s: %w: empty journal", path, types.ErrDecode)
+	}
+	if err := json.Unmarshal(sc.Bytes(), j); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", path, types.ErrDecode, err)
+	}
+	for sc.Scan() {
+		// an entry cut short by a crash is skipped, so its request is redone
+		var e journalEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Done {
+			j.Done[e.RequestId] = true
+		}
+	}
+	return j, sc.Err()
+}
+
+// Remaining returns the requests of the run not yet done, in their
+// original order.
+func (j *Journal) Remaining() []string {
+	var ids []string
+	for _, id := range j.RequestIds {
+		if !j.Done[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ResumeRequests continues the run args.RunId from its journal in
+// args.JournalDir, fetching and publishing the requests it had not yet
+// published, with the CMO filter the run started with.
+func ResumeRequests(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	j, err := ReadJournal(args.JournalDir, args.RunId)
+	if err != nil {
+		return err
+	}
+	ids := j.Remaining()
+	types.Logger(ctx).Info("Resuming run", "mode", args.Mode(), "started_mode", j.Mode, "started_at", j.StartedAt,
+		"total", len(j.RequestIds), "remaining", len(ids))
+	args.CMOReqs = j.CMOReqs
+	return FetchRequests(ctx, m, ids, args)
+}
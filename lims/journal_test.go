@@ -0,0 +1,101 @@
+package lims
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// requestsSeen replays LimsRest responses from testdata, recording the
+// requests fetched and closing stop once stopAt is fetched.
+type requestsSeen struct {
+	ids    []string
+	stopAt string
+	stop   chan struct{}
+}
+
+func (t *requestsSeen) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id, ok := strings.CutPrefix(req.URL.RawQuery, "request="); ok {
+		t.ids = append(t.ids, id)
+		if id == t.stopAt {
+			close(t.stop)
+		}
+	}
+	return (&fetch.ReplayTransport{LimsDir: "testdata"}).RoundTrip(req)
+}
+
+func TestJournal_ResumeSkipsDoneRequests(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	dir := t.TempDir()
+	args := types.Arguments{LimsHost: "igolims.example.org:8443", DateMode: true, CMOReqs: true,
+		RunId: "run-1", JournalDir: dir}
+
+	// 13370 is not a CMO request, so it is skipped and done; 99999 is
+	// unknown and fails; the run is stopped before 13371
+	seen := &requestsSeen{stopAt: "99999", stop: make(chan struct{})}
+	fetch.HTTPClient.Transport = seen
+	FetchRequests(types.WithStop(context.Background(), seen.stop), nil, []string{"13370", "99999", "13371"}, args)
+
+	j, err := ReadJournal(dir, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Mode != "date" || !j.CMOReqs || len(j.RequestIds) != 3 {
+		t.Errorf("Unexpected journal: %+v", j)
+	}
+	if got := j.Remaining(); !reflect.DeepEqual(got, []string{"99999", "13371"}) {
+		t.Errorf("Remaining() = %v", got)
+	}
+
+	// a crash leaves an entry cut short, which is redone
+	f, _ := os.OpenFile(journalPath(dir, "run-1"), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"requestId":"13371","do`)
+	f.Close()
+
+	seen = &requestsSeen{}
+	fetch.HTTPClient.Transport = seen
+	args.DateMode, args.ResumeMode, args.CMOReqs = false, true, false
+	if err = ResumeRequests(context.Background(), nil, args); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	if !reflect.DeepEqual(seen.ids, []string{"99999", "13371"}) {
+		t.Errorf("Resume fetched %v", seen.ids)
+	}
+	if j, err = ReadJournal(dir, "run-1"); err != nil || len(j.RequestIds) != 3 || len(j.Remaining()) != 2 {
+		t.Errorf("Unexpected journal after resume: %+v %v", j, err)
+	}
+	if _, err = ReadJournal(dir, "run-2"); err == nil {
+		t.Error("Expected an error reading a missing journal")
+	}
+
+	// a run left with nothing to resume removes its journal
+	args.ResumeMode, args.CMOReqs, args.RunId = false, true, "run-3"
+	if err = FetchRequests(context.Background(), nil, []string{"13370"}, args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = os.Stat(journalPath(dir, "run-3")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the journal of run-3 removed, got %v", err)
+	}
+
+	// resuming a run whose requests were all done removes its journal
+	args.RunId = "run-4"
+	jw, err := openJournal([]string{"13370"}, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jw.record("13370", nil)
+	jw.close()
+	args.ResumeMode = true
+	if err = ResumeRequests(context.Background(), nil, args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err = os.Stat(journalPath(dir, "run-4")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the journal of run-4 removed, got %v", err)
+	}
+}
@@ -5,71 +5,94 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jinzhu/copier"
 	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/progress"
 	"github.com/mskcc/smile-message-publisher-go/types"
-	sm "github.com/mskcc/smile-messaging-go/mom/nats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
-func getMessaging(args types.Arguments) (*sm.Messaging, error) {
-	return sm.NewMessaging(args.NatsUrl, sm.WithTLS(args.NatsTrustPath, args.NatsKeyPath, args.NatsConName, args.NatsConPw))
+var tracer = otel.Tracer("github.com/mskcc/smile-message-publisher-go/lims")
+
+// limiter throttles calls to every LimsRest endpoint, unlimited by default.
+var limiter = rate.NewLimiter(rate.Inf, 1)
+
+// Endpoints names the LimsRest endpoints called by this package, as given
+// to fetch.Get.
+var Endpoints = []string{"getDeliveries", "getRequestSamples", "getSampleManifest"}
+
+// SetRateLimit limits calls to LimsRest, across all endpoints and
+// goroutines, to rps per second with bursts of up to burst.  An rps of zero
+// removes the limit.
+func SetRateLimit(rps float64, burst int) {
+	limiter.SetLimit(fetch.Limit(rps))
+	limiter.SetBurst(burst)
 }
 
-func getLimsHttpReq(url string, user, pw string) (*http.Request, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+// limsURL returns the URL of a LimsRest API call, over https unless
+// args.LimsScheme says otherwise.
+func limsURL(args types.Arguments, call string) string {
+	scheme := args.LimsScheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/LimsRest/api/%s", scheme, args.LimsHost, call)
+}
+
+// getLimsHttpReq builds a LimsRest request bounded by ctx and a 60 second
+// per-call timeout, and subject to the LimsRest rate limit.  The timeout
+// starts once the rate limit permits the call.
+func getLimsHttpReq(ctx context.Context, url string, user, pw string) (*http.Request, error) {
+	ctx = fetch.WithLimiter(ctx, limiter, "LimsRest")
+	ctx = fetch.WithCallTimeout(ctx, 60*time.Second)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, cancel, err
+		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
 	auth := user + ":" + pw
 	b64Auth := base64.StdEncoding.EncodeToString([]byte(auth))
 	req.Header.Add("Authorization", "Basic "+b64Auth)
-	return req, cancel, nil
+	return req, nil
 }
 
-func FetchRequestsByDate(args types.Arguments) error {
-	reqIds, err := fetchDeliveriesByDate(args)
+func FetchRequestsByDate(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	reqIds, err := FetchDeliveries(ctx, args)
 	if err != nil {
 		return err
 	}
-	return FetchRequests(reqIds, args)
+	return FetchRequests(ctx, m, reqIds, args)
 }
 
-func fetchDeliveriesByDate(args types.Arguments) ([]string, error) {
-	getDelURL := fmt.Sprintf("https://%s/LimsRest/api/getDeliveries?timestamp=%d", args.LimsHost, args.StartDate.UnixMilli())
-	req, cancel, err := getLimsHttpReq(getDelURL, args.LimsUser, args.LimsPW)
-	if err != nil {
-		return nil, err
-	}
-	defer cancel()
-
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
+// FetchDeliveries returns the ids of requests delivered by IGO between
+// args.StartDate and args.EndDate.
+func FetchDeliveries(ctx context.Context, args types.Arguments) ([]string, error) {
+	getDelURL := limsURL(args, fmt.Sprintf("getDeliveries?timestamp=%d", args.StartDate.UnixMilli()))
+	req, err := getLimsHttpReq(ctx, getDelURL, args.LimsUser, args.LimsPW)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP return code != 200: %d\n", resp.StatusCode)
-	}
 
-	var dels []igo.Delivery
-	if err := json.Unmarshal(body, &dels); err != nil {
+	var dels []*igo.Delivery
+	if err := fetch.GetJSON("getDeliveries", req, &dels); err != nil {
 		return nil, err
 	}
 	var reqIds []string
@@ -82,190 +105,283 @@ func fetchDeliveriesByDate(args types.Arguments) ([]string, error) {
 	return reqIds, nil
 }
 
-func FetchRequests(reqIds []string, args types.Arguments) error {
-	m, err := getMessaging(args)
-	if err != nil {
-		return err
+// FetchRequests fetches and publishes each of reqIds in turn.  Once ctx is
+// cancelled or a stop is requested (see types.WithStop) no further requests
+// are started.  Progress is journaled in args.JournalDir, if set, so the run
+// can be resumed with ResumeRequests; the journal is removed once every
+// request is done.
+func FetchRequests(ctx context.Context, m *messaging.Messaging, reqIds []string, args types.Arguments) error {
+	logger := types.Logger(ctx).With("mode", args.Mode())
+	var jw *journalWriter
+	// a resumed run opens its journal even with nothing left, to remove it
+	if args.JournalDir != "" && (len(reqIds) > 0 || args.ResumeMode) {
+		var err error
+		if jw, err = openJournal(reqIds, args); err != nil {
+			return fmt.Errorf("Unable to open journal: %w", err)
+		}
+		logger.Info("Journaling run progress", "path", journalPath(args.JournalDir, args.RunId))
 	}
+	pt := progress.From(ctx)
+	pt.Start(len(reqIds))
+	var errs []error
 	lc := 0
 	for _, id := range reqIds {
-		lc++
-		log.Printf("Attempting to fetch and publish %d of %d request(s): %s\n", lc, len(reqIds), id)
-		req, err := fetchRequest(id, args)
-		if err != nil {
-			log.Printf("Failure to fetch request %s: %s\n", id, err)
-			continue
-		}
-		// skip a non-cmo request if CMOReqs are desired
-		if args.CMOReqs && !req.IsCmoRequest {
-			log.Printf("Skipping non-cmo request %s as 'cmo_requests_only (-c)' flag is set\n", id)
-			continue
+		if err := types.Stopping(ctx); err != nil {
+			logger.Warn("Stopping before remaining request(s)", "remaining", len(reqIds)-lc, "reason", err)
+			if jw != nil {
+				logger.Warn("Continue this run with --resume " + args.RunId)
+			}
+			errs = append(errs, fmt.Errorf("%d request(s) not attempted: %w", len(reqIds)-lc, err))
+			break
 		}
-		sMans := fetchSampleManifests(req, args)
-		rwm := combineRequestAndSamples(req, sMans)
-		out, err := proto.Marshal(&rwm)
+		lc++
+		rl := logger.With("request_id", id)
+		rl.Info("Attempting to fetch and publish request", "index", lc, "total", len(reqIds))
+		err := fetchAndPublishRequest(ctx, m, id, args, rl)
+		pt.Request(err)
 		if err != nil {
-			log.Printf("Failure to serialize request w/manifests %s: %s\n", id, err)
-			continue
+			errs = append(errs, fmt.Errorf("request %s: %w", id, err))
+			recordFailure(id, err, args, rl)
 		}
-		if err = m.Publish(args.LimsPubTop, out); err != nil {
-			log.Printf("Failure to publish request w/manifests %s: %s\n", id, err)
-			continue
+		if jw != nil {
+			if jerr := jw.record(id, err); jerr != nil {
+				rl.Error("Failure to write journal", "error", jerr)
+			}
 		}
-		log.Printf("Successfully fetched and published request %s\n", id)
 	}
-	m.Shutdown()
+	if jw != nil {
+		finishJournal(jw, len(errs) == 0, args, logger)
+	}
+	types.LogSummary(logger, "request(s)", len(reqIds), errs)
+	return errors.Join(errs...)
+}
+
+// fetchAndPublishRequest fetches a request and its sample manifests from
+// LimsRest and publishes them as a single RequestWithManifests message.
+// Requests skipped by the CMO filter are not an error.  Failures are
+// returned as a *stageError.
+func fetchAndPublishRequest(ctx context.Context, m *messaging.Messaging, id string, args types.Arguments, rl *slog.Logger) error {
+	ctx, span := tracer.Start(ctx, "request", trace.WithAttributes(attribute.String("request_id", id)))
+	defer span.End()
+	start := time.Now()
+
+	req, err := FetchRequest(ctx, id, args)
+	fetchedAt := time.Now()
+	if err != nil {
+		rl.Error("Failure to fetch request", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageFetch, err: err}
+	}
+	// skip a non-cmo request if CMOReqs are desired
+	if args.CMOReqs && !req.IsCmoRequest {
+		rl.Info("Skipping non-cmo request as 'cmo_requests_only (-c)' flag is set")
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return nil
+	}
+	sMans, sErrs := fetchSampleManifests(ctx, req, args)
+	for _, se := range sErrs {
+		rl.Error("Failure to fetch sample manifest", "sample_id", se.SampleId, "error", se.Err)
+	}
+	// don't publish a request missing samples only because the run was aborted
+	if err := ctx.Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageFetch, err: context.Cause(ctx)}
+	}
+	_, cspan := tracer.Start(ctx, "combineRequestAndSamples")
+	rwm := combineRequestAndSamples(req, sMans)
+	cspan.End()
+	out, err := proto.Marshal(rwm)
+	if err != nil {
+		rl.Error("Failure to serialize request w/manifests", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageSerialize, err: err}
+	}
+	if args.DryRun {
+		rl.Info("Dry run, not publishing request w/manifests", "topic", args.LimsPubTop, "samples", len(sMans), "bytes", len(out))
+		return nil
+	}
+	md := messaging.Metadata{Source: messaging.SourceLims, RequestId: id, RunId: args.RunId, Type: string(proto.MessageName(rwm)), FetchedAt: fetchedAt}
+	if err = m.PublishContext(ctx, args.LimsPubTop, out, md); err != nil {
+		rl.Error("Failure to publish request w/manifests", "topic", args.LimsPubTop, "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StagePublish, topic: args.LimsPubTop, payload: out, err: err}
+	}
+	rl.Info("Successfully fetched and published request", "topic", args.LimsPubTop, "samples", len(sMans),
+		"duration_ms", time.Since(start).Milliseconds())
 	return nil
 }
 
-func protoMarshal(jsonContent []byte) ([]byte, error) {
-	rwm := igo.RequestWithManifests{}
-	if err := json.Unmarshal([]byte(jsonContent), &rwm); err != nil {
-		return nil, err
+// protoMarshal serializes a JSON RequestWithManifests, returning the decoded
+// request alongside its protobuf encoding.
+func protoMarshal(jsonContent []byte) (*igo.RequestWithManifests, []byte, error) {
+	rwm := &igo.RequestWithManifests{}
+	if err := json.Unmarshal([]byte(jsonContent), rwm); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", types.ErrDecode, err)
 	}
-	return proto.Marshal(&rwm)
+	out, err := proto.Marshal(rwm)
+	return rwm, out, err
 }
 
-func FetchRequestFromJSONFile(args types.Arguments) error {
-	log.Printf("Attempting to fetch & publish request from JSON file\n")
+func FetchRequestFromJSONFile(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	logger := types.Logger(ctx).With("mode", args.Mode(), "file", args.JSONFilePath)
+	logger.Info("Attempting to fetch & publish request from JSON file")
 	file, err := ioutil.ReadFile(args.JSONFilePath)
 	if err != nil {
 		return err
 	}
-	out, err := protoMarshal(file)
-	if err != nil {
+	if _, err = PublishRequestJSON(ctx, m, file, messaging.SourceJSONFile, args); err != nil {
 		return err
 	}
-	m, err := getMessaging(args)
+	logger.Info("Successfully fetched and published request from JSON file", "topic", args.LimsPubTop)
+	return nil
+}
+
+// PublishRequestJSON publishes a RequestWithManifests given as JSON to
+// args.LimsPubTop, returning its request id.  source is reported in the
+// Smile-Source header.
+func PublishRequestJSON(ctx context.Context, m *messaging.Messaging, jsonContent []byte, source string, args types.Arguments) (string, error) {
+	fetchedAt := time.Now()
+	rwm, out, err := protoMarshal(jsonContent)
 	if err != nil {
-		return err
-	}
-	if err = m.Publish(args.LimsPubTop, out); err != nil {
-		return err
+		return "", err
 	}
-	log.Printf("Successfully fetched and published request from JSON file\n")
-	return nil
+	md := messaging.Metadata{Source: source, RequestId: rwm.RequestId, RunId: args.RunId, Type: string(proto.MessageName(rwm)), FetchedAt: fetchedAt}
+	return rwm.RequestId, m.PublishContext(ctx, args.LimsPubTop, out, md)
 }
 
-func FetchRequestFromPublisherFile(args types.Arguments) error {
+func FetchRequestFromPublisherFile(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
 	inFile, err := os.Open(args.PublisherFilePath)
 	if err != nil {
 		return err
 	}
 	defer inFile.Close()
 	rd := bufio.NewReader(inFile)
-	m, err := getMessaging(args)
-	if err != nil {
-		return err
-	}
+	logger := types.Logger(ctx).With("mode", args.Mode(), "file", args.PublisherFilePath)
+	var errs []error
 	lc := 0
 	for {
+		if err := types.Stopping(ctx); err != nil {
+			logger.Warn("Stopping before remaining row(s)", "row", lc+1, "reason", err)
+			errs = append(errs, fmt.Errorf("rows from %d not attempted: %w", lc+1, err))
+			lc++
+			break
+		}
 		lc++
-		log.Printf("Attempting to process row %d from publisher file\n", lc)
+		rl := logger.With("row", lc)
+		rl.Info("Attempting to process row from publisher file")
 		line, err := rd.ReadString('\n')
 		if err == io.EOF {
 			break
 		} else if err != nil {
+			errs = append(errs, fmt.Errorf("row %d: %w", lc, err))
 			break
 		}
 		parts := strings.Split(line, "\t")
 		if len(parts) != 3 {
-			log.Printf("Error parsing row %d from publisher file, expecting 3 components, found %d\n", lc, len(parts))
+			rl.Error("Error parsing row from publisher file, expecting 3 components", "components", len(parts))
+			errs = append(errs, fmt.Errorf("row %d: %w: expecting 3 components, found %d", lc, types.ErrDecode, len(parts)))
 			continue
 		}
-		out, err := protoMarshal([]byte(parts[2]))
+		rwm, out, err := protoMarshal([]byte(parts[2]))
 		if err != nil {
-			log.Printf("Failure to serialize row %d from publisher file: %s\n", lc, err)
+			rl.Error("Failure to serialize row from publisher file", "error", err)
+			errs = append(errs, fmt.Errorf("row %d: %w", lc, err))
 			continue
 		}
-		if err = m.Publish(parts[1], out); err != nil {
-			log.Printf("Failure to publish row %d from publisher file: %s\n", lc, err)
+		md := messaging.Metadata{Source: messaging.SourcePublisherFile, RequestId: rwm.RequestId, RunId: args.RunId, Type: string(proto.MessageName(rwm)), FetchedAt: time.Now()}
+		if err = m.PublishContext(ctx, parts[1], out, md); err != nil {
+			rl.Error("Failure to publish row from publisher file", "topic", parts[1], "error", err)
+			errs = append(errs, fmt.Errorf("row %d: %w", lc, err))
 			continue
 		}
-		log.Printf("Successfully processed row %d of publisher file\n", lc)
+		rl.Info("Successfully processed row of publisher file", "topic", parts[1])
 	}
-	return err
+	types.LogSummary(logger, "request(s)", lc-1, errs)
+	return errors.Join(errs...)
 }
 
-func fetchRequest(reqId string, args types.Arguments) (igo.Request, error) {
-	var iReq igo.Request
-	getReqURL := fmt.Sprintf("https://%s/LimsRest/api/getRequestSamples?request=%s", args.LimsHost, reqId)
-	req, cancel, err := getLimsHttpReq(getReqURL, args.LimsUser, args.LimsPW)
+// FetchRequest fetches a request, listing its samples, from LimsRest.
+func FetchRequest(ctx context.Context, reqId string, args types.Arguments) (*igo.Request, error) {
+	getReqURL := limsURL(args, "getRequestSamples?request="+url.QueryEscape(reqId))
+	req, err := getLimsHttpReq(ctx, getReqURL, args.LimsUser, args.LimsPW)
 	if err != nil {
-		return iReq, err
+		return nil, err
 	}
-	defer cancel()
 
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return iReq, err
+	iReq := &igo.Request{}
+	if err := fetch.GetJSON("getRequestSamples", req, iReq); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
+	return iReq, nil
+}
+
+// FetchRequestWithManifests fetches a request and the manifests of its
+// samples from LimsRest, combined into a RequestWithManifests.  If some
+// manifests cannot be fetched the request is still returned without those
+// samples, together with an error joining a *SampleError for each.
+func FetchRequestWithManifests(ctx context.Context, reqId string, args types.Arguments) (*igo.RequestWithManifests, error) {
+	req, err := FetchRequest(ctx, reqId, args)
 	if err != nil {
-		return iReq, err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return iReq, fmt.Errorf("HTTP return code != 200: %d\n", resp.StatusCode)
+	sMans, sErrs := fetchSampleManifests(ctx, req, args)
+	rwm := combineRequestAndSamples(req, sMans)
+	var errs []error
+	for _, se := range sErrs {
+		errs = append(errs, se)
 	}
-	err = json.Unmarshal(body, &iReq)
-	return iReq, err
+	return rwm, errors.Join(errs...)
 }
 
-func fetchSampleManifests(iReq igo.Request, args types.Arguments) []igo.SampleManifest {
-	var manifests []igo.SampleManifest
+func fetchSampleManifests(ctx context.Context, iReq *igo.Request, args types.Arguments) ([]*igo.SampleManifest, []*SampleError) {
+	var manifests []*igo.SampleManifest
+	var errs []*SampleError
 	ns := len(iReq.GetSamples())
 	lc := 0
 	for _, s := range iReq.GetSamples() {
+		if ctx.Err() != nil {
+			errs = append(errs, &SampleError{SampleId: s.IgoSampleId, Err: context.Cause(ctx)})
+			break
+		}
 		lc++
-		log.Printf("Attempting to fetch %d of %d sample manifest(s): %s\n", lc, ns, s.IgoSampleId)
-		man, err := fetchSampleManifest(s.IgoSampleId, args)
+		sl := types.Logger(ctx).With("request_id", iReq.RequestId, "sample_id", s.IgoSampleId)
+		start := time.Now()
+		sl.Debug("Attempting to fetch sample manifest", "index", lc, "total", ns)
+		man, err := FetchSampleManifest(ctx, s.IgoSampleId, args)
 		if err != nil {
-			log.Printf("Failure to fetch sample manifest %s: %s\n", s.IgoSampleId, err)
+			errs = append(errs, &SampleError{SampleId: s.IgoSampleId, Err: err})
 			continue
 		}
 		man.IgoComplete = s.IgoComplete
 		manifests = append(manifests, man)
-		log.Printf("Successfully fetched sample manifest %s\n", s.IgoSampleId)
+		progress.From(ctx).Sample()
+		sl.Debug("Successfully fetched sample manifest", "duration_ms", time.Since(start).Milliseconds())
 	}
-	return manifests
+	return manifests, errs
 }
 
-func fetchSampleManifest(sId string, args types.Arguments) (igo.SampleManifest, error) {
-	var manifest igo.SampleManifest
-	getManURL := fmt.Sprintf("https://%s/LimsRest/api/getSampleManifest?igoSampleId=%s", args.LimsHost, sId)
-	req, cancel, err := getLimsHttpReq(getManURL, args.LimsUser, args.LimsPW)
-	if err != nil {
-		return manifest, err
-	}
-	defer cancel()
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
+// FetchSampleManifest fetches the manifest of a single IGO sample.
+func FetchSampleManifest(ctx context.Context, sId string, args types.Arguments) (*igo.SampleManifest, error) {
+	getManURL := limsURL(args, "getSampleManifest?igoSampleId="+url.QueryEscape(sId))
+	req, err := getLimsHttpReq(ctx, getManURL, args.LimsUser, args.LimsPW)
 	if err != nil {
-		return manifest, err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return manifest, err
+
+	var mans []*igo.SampleManifest
+	if err := fetch.GetJSON("getSampleManifest", req, &mans); err != nil {
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return manifest, fmt.Errorf("HTTP return code != 200: %d\n", resp.StatusCode)
+	if len(mans) == 0 {
+		return nil, &types.FetchError{Kind: types.ErrNotFound, URL: getManURL, StatusCode: http.StatusOK}
 	}
-	var mans []igo.SampleManifest
-	err = json.Unmarshal(body, &mans)
-	return mans[0], err
+	return mans[0], nil
 }
 
-func combineRequestAndSamples(iReq igo.Request, sMans []igo.SampleManifest) igo.RequestWithManifests {
-	rwm := igo.RequestWithManifests{}
-	copier.Copy(&rwm, &iReq)
-	var combMans []*igo.SampleManifest
-	for i, _ := range sMans {
-		combMans = append(combMans, &sMans[i])
-	}
-	rwm.Samples = combMans
+func combineRequestAndSamples(iReq *igo.Request, sMans []*igo.SampleManifest) *igo.RequestWithManifests {
+	rwm := &igo.RequestWithManifests{}
+	copier.Copy(rwm, iReq)
+	rwm.Samples = sMans
 	rwm.ProjectId = strings.Split(iReq.RequestId, "_")[0]
 	return rwm
 }
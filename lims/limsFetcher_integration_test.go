@@ -5,6 +5,7 @@
 package lims
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"github.com/google/go-cmp/cmp"
@@ -46,7 +47,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestLimsFetcher_fetchDeliveriesByData(t *testing.T) {
-	reqIds, err := fetchDeliveriesByDate(args)
+	reqIds, err := FetchDeliveries(context.Background(), args)
 	if err != nil {
 		t.Error("Unexpected error: ", err)
 	}
@@ -55,18 +56,18 @@ func TestLimsFetcher_fetchDeliveriesByData(t *testing.T) {
 	}
 }
 
-func openExpectedRequest(t *testing.T) (igo.Request, error) {
-	req := igo.Request{}
-	jsonBytes, err := ioutil.ReadFile("testData/13370.json")
+func openExpectedRequest(t *testing.T) (*igo.Request, error) {
+	req := &igo.Request{}
+	jsonBytes, err := ioutil.ReadFile("testdata/13370.json")
 	if err != nil {
 		return req, err
 	}
-	err = json.Unmarshal(jsonBytes, &req)
+	err = json.Unmarshal(jsonBytes, req)
 	return req, err
 }
 
 func TestLimsFetcher_fetchRequestIntegration(t *testing.T) {
-	req, err := fetchRequest("13370", args)
+	req, err := FetchRequest(context.Background(), "13370", args)
 	if err != nil {
 		t.Error("Unexpected  error: ", err)
 	}
@@ -84,7 +85,10 @@ func TestLimsFetcher_fetchSampleManifestsIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	sms := fetchSampleManifests(req, args)
+	sms, errs := fetchSampleManifests(context.Background(), req, args)
+	if len(errs) != 0 {
+		t.Error("Unexpected errors: ", errs)
+	}
 	if len(sms) != 4 {
 		t.Error("incorrect result: expected 4, got", len(sms))
 	}
@@ -102,18 +106,18 @@ func TestLimsFetcher_fetchSampleManifestsIntegration(t *testing.T) {
 	}
 }
 
-func openExpectedSampleManifest(t *testing.T) (igo.SampleManifest, error) {
-	man := igo.SampleManifest{}
-	jsonBytes, err := ioutil.ReadFile("testData/13370_1.json")
+func openExpectedSampleManifest(t *testing.T) (*igo.SampleManifest, error) {
+	man := &igo.SampleManifest{}
+	jsonBytes, err := ioutil.ReadFile("testdata/13370_1.json")
 	if err != nil {
 		return man, err
 	}
-	err = json.Unmarshal(jsonBytes, &man)
+	err = json.Unmarshal(jsonBytes, man)
 	return man, err
 }
 
 func TestLimsFetcher_fetchSampleManifestIntegration(t *testing.T) {
-	man, err := fetchSampleManifest("13370_1", args)
+	man, err := FetchSampleManifest(context.Background(), "13370_1", args)
 	if err != nil {
 		t.Error("Unexpected  error: ", err)
 	}
@@ -0,0 +1,28 @@
+package lims
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"testing"
+)
+
+func TestLimsFetcher_FetchRequestWithManifestsReplay(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	fetch.HTTPClient.Transport = &fetch.ReplayTransport{LimsDir: "testdata"}
+	args := types.Arguments{LimsHost: "igolims.example.org:8443"}
+
+	// only the manifest of 13370_1 is recorded in testdata
+	rwm, err := FetchRequestWithManifests(context.Background(), "13370", args)
+	if rwm == nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if rwm.RequestId != "13370" || rwm.ProjectId != "13370" || len(rwm.Samples) != 1 || rwm.Samples[0].IgoId != "13370_1" {
+		t.Errorf("Unexpected request: %v", rwm)
+	}
+	var se *SampleError
+	if !errors.As(err, &se) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found sample errors, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package lims
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/progress"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sampleRequestId returns the id of the request an IGO sample id belongs
+// to: its first component, and its second if that is a request letter
+// suffix, e.g. 05274_C for 05274_C_1 and 05274_C_1_1, and 13370 for 13370_1.
+func sampleRequestId(sId string) (string, error) {
+	parts := strings.Split(sId, "_")
+	n := 1
+	if len(parts) > 1 && isLetters(parts[1]) {
+		n = 2
+	}
+	if len(parts) <= n || slices.Contains(parts, "") {
+		return "", fmt.Errorf("%w: malformed IGO sample id %q", types.ErrDecode, sId)
+	}
+	return strings.Join(parts[:n], "_"), nil
+}
+
+// isLetters reports whether s is a non-empty run of ASCII letters.
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// FetchSamples fetches the manifest of each of args.SampleIds in turn and
+// publishes it as a SampleManifest to args.LimsSampleTop.  The request of
+// each sample is fetched once, to apply the CMO filter and its IGO complete
+// flag.  With args.DryRun nothing is published.  Failed samples are
+// recorded in the dead-letter file, if one is configured.
+func FetchSamples(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	logger := types.Logger(ctx).With("mode", args.Mode())
+	reqs := map[string]*igo.Request{}
+	pt := progress.From(ctx)
+	pt.Start(len(args.SampleIds))
+	var errs []error
+	lc := 0
+	for _, sId := range args.SampleIds {
+		if err := types.Stopping(ctx); err != nil {
+			logger.Warn("Stopping before remaining sample(s)", "remaining", len(args.SampleIds)-lc, "reason", err)
+			errs = append(errs, fmt.Errorf("%d sample(s) not attempted: %w", len(args.SampleIds)-lc, err))
+			break
+		}
+		lc++
+		sl := logger.With("sample_id", sId)
+		sl.Info("Attempting to fetch and publish sample", "index", lc, "total", len(args.SampleIds))
+		err := fetchAndPublishSample(ctx, m, sId, reqs, args, sl)
+		pt.Request(err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sample %s: %w", sId, err))
+			recordSampleFailure(sId, err, args, sl)
+		}
+	}
+	types.LogSummary(logger, "sample(s)", len(args.SampleIds), errs)
+	return errors.Join(errs...)
+}
+
+// fetchAndPublishSample fetches the manifest of a sample from LimsRest and
+// publishes it, caching the sample's request in reqs.  Samples skipped by
+// the CMO filter are not an error.  Failures are returned as a *stageError.
+func fetchAndPublishSample(ctx context.Context, m *messaging.Messaging, sId string, reqs map[string]*igo.Request, args types.Arguments, sl *slog.Logger) error {
+	ctx, span := tracer.Start(ctx, "sample", trace.WithAttributes(attribute.String("sample_id", sId)))
+	defer span.End()
+	start := time.Now()
+
+	reqId, err := sampleRequestId(sId)
+	if err != nil {
+		sl.Error("Failure to parse sample id", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageFetch, topic: args.LimsSampleTop, err: err}
+	}
+	sl = sl.With("request_id", reqId)
+	req, ok := reqs[reqId]
+	if !ok {
+		if req, err = FetchRequest(ctx, reqId, args); err != nil {
+			sl.Error("Failure to fetch request of sample", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			return &stageError{stage: StageFetch, topic: args.LimsSampleTop, err: err}
+		}
+		reqs[reqId] = req
+	}
+	// skip a sample of a non-cmo request if CMOReqs are desired
+	if args.CMOReqs && !req.IsCmoRequest {
+		sl.Info("Skipping sample of non-cmo request as 'cmo_requests_only (-c)' flag is set")
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return nil
+	}
+	man, err := FetchSampleManifest(ctx, sId, args)
+	fetchedAt := time.Now()
+	if err != nil {
+		sl.Error("Failure to fetch sample manifest", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageFetch, topic: args.LimsSampleTop, err: err}
+	}
+	progress.From(ctx).Sample()
+	for _, s := range req.GetSamples() {
+		if s.IgoSampleId == sId {
+			man.IgoComplete = s.IgoComplete
+		}
+	}
+	out, err := proto.Marshal(man)
+	if err != nil {
+		sl.Error("Failure to serialize sample manifest", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StageSerialize, topic: args.LimsSampleTop, err: err}
+	}
+	if args.DryRun {
+		sl.Info("Dry run, not publishing sample manifest", "topic", args.LimsSampleTop, "bytes", len(out))
+		return nil
+	}
+	md := messaging.Metadata{Source: messaging.SourceLims, RequestId: reqId, SampleId: sId, RunId: args.RunId,
+		Type: string(proto.MessageName(man)), FetchedAt: fetchedAt}
+	if err = m.PublishContext(ctx, args.LimsSampleTop, out, md); err != nil {
+		sl.Error("Failure to publish sample manifest", "topic", args.LimsSampleTop, "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return &stageError{stage: StagePublish, topic: args.LimsSampleTop, payload: out, err: err}
+	}
+	sl.Info("Successfully fetched and published sample", "topic", args.LimsSampleTop,
+		"duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
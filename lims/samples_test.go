@@ -0,0 +1,84 @@
+package lims
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/progress"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSamples_FetchSamplesDryRun(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	seen := &requestsSeen{}
+	fetch.HTTPClient.Transport = seen
+	args := types.Arguments{LimsHost: "igolims.example.org:8443", SampleMode: true, DryRun: true,
+		SampleIds: []string{"13370_1", "13370_2", "13370"}}
+
+	// only the manifest of 13370_1 is recorded in testdata; 13370 is not a
+	// sample id
+	err := FetchSamples(context.Background(), nil, args)
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrDecode) {
+		t.Errorf("Expected not found and decode errors, got %v", err)
+	}
+	if !reflect.DeepEqual(seen.ids, []string{"13370"}) {
+		t.Errorf("Expected request 13370 to be fetched once, fetched %v", seen.ids)
+	}
+
+	// 13370 is not a CMO request, so its samples are skipped
+	args.CMOReqs = true
+	args.SampleIds = []string{"13370_1", "13370_2"}
+	if err = FetchSamples(context.Background(), nil, args); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSamples_TrackAndRecordFailures(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	fetch.HTTPClient.Transport = &fetch.ReplayTransport{LimsDir: "testdata"}
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	args := types.Arguments{LimsHost: "igolims.example.org:8443", LimsSampleTop: "igo.sample", SampleMode: true,
+		DryRun: true, DeadLetterPath: path, SampleIds: []string{"13370_1", "13370_2", "13370"}}
+	tr := &progress.Tracker{}
+	FetchSamples(progress.WithTracker(context.Background(), tr), nil, args)
+	if s := tr.Snapshot(); s.Total != 3 || s.Done != 3 || s.Failed != 2 || s.Samples != 1 {
+		t.Errorf("Unexpected progress %+v", s)
+	}
+
+	dls, err := ReadDeadLetters(path)
+	if err != nil || len(dls) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v %v", dls, err)
+	}
+	if dl := dls[0]; dl.SampleId != "13370_2" || dl.RequestId != "13370" || dl.Topic != "igo.sample" || !dl.Permanent {
+		t.Errorf("Unexpected entry: %+v", dl)
+	}
+	if dl := dls[1]; dl.SampleId != "13370" || dl.RequestId != "" {
+		t.Errorf("Unexpected entry: %+v", dl)
+	}
+
+	// a sample is retried as a sample, keeping its sample id
+	dls[0].Permanent = false
+	if err = writeDeadLetters(path, dls[:1]); err != nil {
+		t.Fatal(err)
+	}
+	args.SampleMode, args.RetryMode, args.LimsSampleTop = false, true, ""
+	if err = RetryDeadLetters(context.Background(), nil, args); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	if dls, err = ReadDeadLetters(path); err != nil || len(dls) != 1 || dls[0].SampleId != "13370_2" || dls[0].Topic != "igo.sample" {
+		t.Errorf("Unexpected entries: %+v %v", dls, err)
+	}
+}
+
+func TestSamples_sampleRequestId(t *testing.T) {
+	for sId, want := range map[string]string{"13370_1": "13370", "05274_C_12": "05274_C", "05274_C_1_1": "05274_C",
+		"13370_1_1": "13370", "13370": "", "_1": "", "13370_": "", "05274_C": "", "05274__1": ""} {
+		got, err := sampleRequestId(sId)
+		if got != want || (want == "") != errors.Is(err, ErrDecode) {
+			t.Errorf("sampleRequestId(%q) = %q, %v", sId, got, err)
+		}
+	}
+}
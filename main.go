@@ -1,20 +1,60 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
 	"github.com/mskcc/smile-message-publisher-go/lims"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/metrics"
+	"github.com/mskcc/smile-message-publisher-go/progress"
 	"github.com/mskcc/smile-message-publisher-go/smile"
+	"github.com/mskcc/smile-message-publisher-go/tracing"
 	"github.com/mskcc/smile-message-publisher-go/types"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"log"
-	"net/url"
+	"io"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// Exit codes reported when a run fails, by class of failure.
+const (
+	exitOK = iota
+	exitFailure
+	exitNotFound
+	exitUnauthorized
+	exitTimeout
+	exitDecode
+	exitPublish
+	exitInterrupted = 130
+)
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, types.ErrInterrupted), errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, types.ErrUnauthorized):
+		return exitUnauthorized
+	case errors.Is(err, types.ErrPublish):
+		return exitPublish
+	case errors.Is(err, types.ErrTimeout):
+		return exitTimeout
+	case errors.Is(err, types.ErrDecode):
+		return exitDecode
+	case errors.Is(err, types.ErrNotFound):
+		return exitNotFound
+	}
+	return exitFailure
+}
+
 func setupOptions() {
 	pflag.BoolP("help", "h", false, "Describes available options")
 	pflag.StringP("cfg_file", "f", "", "Path to configuration file containing Lims, Nats settings & creds")
@@ -25,8 +65,68 @@ func setupOptions() {
 	pflag.StringP("json_filename", "j", "", "Publishes contents of provided JSON file")
 	pflag.StringP("publisher_filename", "p", "", "Publishes contents of provided JSON file")
 	pflag.StringP("smile_service", "m", "", "Comma-separated list of request ids to fetch from Smile Web Service")
+	pflag.String("sample_ids", "", "Comma-separated list of IGO sample ids whose manifests to fetch from LimsRest and publish to lims.sample_topic")
+	pflag.Bool("dry_run", false, "Fetch and serialize requests or samples from LimsRest without connecting to NATS or publishing")
+	pflag.String("debug_http", "", "Directory to dump HTTP request/response pairs into, with credentials redacted")
+	pflag.String("log_level", "info", "Log level [debug|info|warn|error]")
+	pflag.String("log_format", "logfmt", "Log format [logfmt|json]")
+	pflag.String("metrics_addr", "", "Address to expose Prometheus metrics on at /metrics while running, e.g. :9090")
+	pflag.String("trace_exporter", "none", "OpenTelemetry trace exporter [none|stdout|otlp]")
+	pflag.String("trace_endpoint", "localhost:4318", "OTLP/HTTP collector address used by the otlp trace exporter")
+	pflag.String("metrics_textfile", "", "File to write Prometheus metrics to on exit, for a textfile collector")
+	pflag.String("profile", "", "Named profile from the config file's profiles section to apply over its base sections")
+	pflag.Bool("yes", false, "Confirm runs against a protected profile without prompting")
+	pflag.Bool("dump_config", false, "Print the effective config, with secrets redacted, and exit")
+	pflag.String("cache_dir", "", "Directory to cache LimsRest responses in between runs")
+	pflag.Duration("cache_ttl", time.Hour, "Age after which cached LimsRest responses are revalidated")
+	pflag.String("cache_mode", fetch.CacheUse, "Response cache mode [use|only|refresh]; only serves cached responses without calling LimsRest")
+	pflag.String("fixtures_dir", ".", "Repository root to write record-fixtures output under, into lims/testdata and smile/testdata")
+	pflag.Bool("strip_phi", false, "Replace patient and personal identifiers in fixtures written by record-fixtures")
+	pflag.String("fake_lims_addr", "localhost:8081", "Address fake-lims listens on")
+	pflag.String("fake_lims_dir", "", "Directory of request and sample manifest fixtures served by fake-lims, e.g. lims/testdata")
+	pflag.Int("fake_lims_generate", 0, "Number of requests fake-lims generates, delivered one per day up to today")
+	pflag.Int("fake_lims_samples", 4, "Number of samples in each request generated by fake-lims")
+	pflag.String("fake_lims_user", "fake", "Basic auth user fake-lims accepts")
+	pflag.String("fake_lims_password", "fake", "Basic auth password fake-lims accepts")
+	pflag.String("api_addr", ":8080", "Address the serve command exposes the publish API on")
+	pflag.Duration("lims_ready_threshold", 5*time.Minute, "How long LimsRest calls may fail before the serve command reports not ready at /readyz")
+	pflag.String("dead_letter_file", "", "File failed LimsRest requests are appended to, and retry-failed reprocesses; failures are not recorded unless set")
+	pflag.String("journal_dir", "", "Directory each run journals its progress in, for --resume; runs are not journaled unless set")
+	pflag.String("resume", "", "Run id of an interrupted run to resume from its journal, skipping requests it already published")
+	pflag.Bool("progress", false, "Report progress with ETA: a live status line on a terminal, otherwise periodic log lines")
+	pflag.Duration("progress_interval", 30*time.Second, "How often --progress logs progress when not on a terminal")
+	pflag.Duration("overall_timeout", 0, "Deadline for the whole run, e.g. 2h; in-flight requests are cancelled when it passes")
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
+	setupEnv()
+}
+
+// progressTerm keeps the --progress status line below log output on a
+// terminal, nil otherwise.
+var progressTerm *progress.Terminal
+
+func setupLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(viper.GetString("log_level"))); err != nil {
+		return fmt.Errorf("Invalid log_level: %s", viper.GetString("log_level"))
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var out io.Writer = os.Stderr
+	if viper.GetBool("progress") && isTerminal(os.Stderr) {
+		progressTerm = progress.NewTerminal(os.Stderr)
+		out = progressTerm
+	}
+	var handler slog.Handler
+	switch viper.GetString("log_format") {
+	case "logfmt":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("Invalid log_format: %s", viper.GetString("log_format"))
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
 }
 
 func parseDates(args *types.Arguments) error {
@@ -70,6 +170,16 @@ func parseReqIds(args *types.Arguments) error {
 	return nil
 }
 
+func parseSampleIds(args *types.Arguments) error {
+	sampleIds := viper.GetString("sample_ids")
+	if sampleIds == "" {
+		return nil
+	}
+	args.SampleIds = strings.Split(sampleIds, ",")
+	args.SampleMode = true
+	return nil
+}
+
 func parseJSONFile(args *types.Arguments) error {
 	jFile := viper.GetString("json_filename")
 	if jFile == "" {
@@ -102,130 +212,292 @@ func parseSmileServiceMode(args *types.Arguments) error {
 	return nil
 }
 
-func readConfig(cfg types.Config, args *types.Arguments) error {
-	viper.SetConfigName(cfg.Name)
-	viper.SetConfigType(cfg.Type)
-	viper.AddConfigPath(cfg.Path)
-	if err := viper.ReadInConfig(); err != nil {
-		return err
+func parseArgs() (types.Arguments, error) {
+	toReturn := types.Arguments{}
+
+	if viper.GetBool("help") {
+		pflag.PrintDefaults()
+		return toReturn, nil
 	}
-	if args.LimsHost = viper.GetString("lims.host"); args.LimsHost == "" {
-		return fmt.Errorf("Missing lims.host property in config file")
+
+	config, err := parseConfig()
+	if err != nil {
+		return toReturn, err
 	}
-	if args.LimsUser = viper.GetString("lims.username"); args.LimsUser == "" {
-		return fmt.Errorf("Missing lims.username property in config file")
+
+	if err = parseDates(&toReturn); err != nil {
+		return toReturn, err
 	}
-	if args.LimsPW = viper.GetString("lims.password"); args.LimsPW == "" {
-		return fmt.Errorf("Missing lims.password property in config file")
+	parseReqIds(&toReturn)
+	parseSampleIds(&toReturn)
+	parseJSONFile(&toReturn)
+	parsePublisherFile(&toReturn)
+	parseSmileServiceMode(&toReturn)
+	toReturn.RetryMode = pflag.Arg(0) == "retry-failed"
+	toReturn.RecordMode = pflag.Arg(0) == "record-fixtures"
+	toReturn.ResumeMode = viper.GetString("resume") != ""
+	if toReturn.ResumeMode && toReturn.Mode() != "resume" {
+		return toReturn, fmt.Errorf("resume cannot be combined with another mode")
 	}
-	if args.LimsPubTop = viper.GetString("lims.publisher_topic"); args.LimsPubTop == "" {
-		return fmt.Errorf("Missing lims.publisher_topic property in config file")
+	if toReturn.SampleMode && (toReturn.ReqIdMode || toReturn.DateMode || toReturn.JSONFileMode ||
+		toReturn.PublisherFileMode || toReturn.SmileServiceMode || toReturn.RetryMode) {
+		return toReturn, fmt.Errorf("sample_ids cannot be combined with another mode")
 	}
-	u, err := url.Parse(viper.GetString("nats.url"))
-	if err != nil {
-		return fmt.Errorf("Missing or malformed nats.url property in config file")
-	} else {
-		args.NatsUrl = u.String()
+
+	if toReturn.DryRun = viper.GetBool("dry_run"); toReturn.DryRun {
+		switch toReturn.Mode() {
+		case "request_ids", "date", "sample_ids":
+		default:
+			return toReturn, fmt.Errorf("dry_run is only supported with request_ids, start_date/end_date or sample_ids")
+		}
 	}
-	if args.NatsConName = viper.GetString("nats.consumer_name"); args.NatsConName == "" {
-		return fmt.Errorf("Missing nats.consumer_name property in config file")
+
+	// the config is read once the mode is known, so only the sections
+	// it uses are required
+	if err = readConfig(config, &toReturn); err != nil {
+		return toReturn, err
 	}
-	if args.NatsConPw = viper.GetString("nats.consumer_password"); args.NatsConPw == "" {
-		return fmt.Errorf("Missing nats.consumer_password property in config file")
+	toReturn.CMOReqs = viper.GetBool("cmo_requests_only")
+	toReturn.RunId = types.NewRunId()
+	if toReturn.ResumeMode {
+		toReturn.RunId = viper.GetString("resume")
 	}
-	if args.NatsKeyPath = viper.GetString("nats.keystore_path"); args.NatsKeyPath == "" {
-		return fmt.Errorf("Missing nats.keystore_path property in config file")
+	toReturn.DebugHTTPDir = viper.GetString("debug_http")
+	toReturn.MetricsAddr = viper.GetString("metrics_addr")
+	toReturn.MetricsTextfile = viper.GetString("metrics_textfile")
+	toReturn.TraceExporter = viper.GetString("trace_exporter")
+	toReturn.TraceEndpoint = viper.GetString("trace_endpoint")
+	toReturn.OverallTimeout = viper.GetDuration("overall_timeout")
+	if toReturn.OverallTimeout < 0 {
+		return toReturn, fmt.Errorf("Invalid overall_timeout: %s", toReturn.OverallTimeout)
 	}
-	if args.NatsTrustPath = viper.GetString("nats.truststore_path"); args.NatsTrustPath == "" {
-		return fmt.Errorf("Missing nats.truststore_path property in config file")
+	toReturn.LimsFailureGrace = viper.GetDuration("lims_ready_threshold")
+	toReturn.CacheDir = viper.GetString("cache_dir")
+	toReturn.CacheTTL = viper.GetDuration("cache_ttl")
+	toReturn.CacheMode = viper.GetString("cache_mode")
+	toReturn.DeadLetterPath = viper.GetString("dead_letter_file")
+	if toReturn.DryRun {
+		toReturn.DeadLetterPath = ""
 	}
-	u, err = url.Parse(viper.GetString("smile.request_url"))
-	if err != nil {
-		return fmt.Errorf("Missing or malformed smile.request_url property in config file")
-	} else {
-		args.SmileRequestUrl = u.String()
+	if toReturn.RetryMode && toReturn.DeadLetterPath == "" {
+		return toReturn, fmt.Errorf("retry-failed needs a dead_letter_file")
 	}
-	if args.SmilePubTop = viper.GetString("smile.publisher_topic"); args.SmilePubTop == "" {
-		return fmt.Errorf("Missing smile.publisher_topic property in config file")
+	toReturn.JournalDir = viper.GetString("journal_dir")
+	if toReturn.DryRun {
+		// a dry run publishes nothing, so must not be resumed as if it had
+		toReturn.JournalDir = ""
 	}
-	return nil
-}
-
-func parseConfig() (types.Config, error) {
-	toReturn := types.Config{}
-	cf := viper.GetString("cfg_file")
-	if cf == "" {
-		return toReturn, fmt.Errorf("Missing cfg_file argument")
+	if viper.GetBool("progress") && viper.GetDuration("progress_interval") <= 0 {
+		return toReturn, fmt.Errorf("Invalid progress_interval: %s", viper.GetDuration("progress_interval"))
+	}
+	if toReturn.ResumeMode && toReturn.JournalDir == "" {
+		return toReturn, fmt.Errorf("resume needs a journal_dir")
 	}
-	ext := filepath.Ext(cf)
-	name := filepath.Base(cf)
-	toReturn.Name = strings.TrimSuffix(name, ext)
-	toReturn.Type = strings.TrimPrefix(ext, ".")
-	toReturn.Path = filepath.Dir(cf)
-
 	return toReturn, nil
 }
 
-func parseArgs() (types.Arguments, error) {
-	toReturn := types.Arguments{}
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-	if viper.GetBool("help") {
-		pflag.PrintDefaults()
-		return toReturn, nil
+func closeMessaging(m *messaging.Messaging, args types.Arguments) {
+	if err := m.Close(args.NatsFlushTimeout); err != nil {
+		slog.Error("Error closing NATS connection", "error", err)
 	}
+}
 
-	config, err := parseConfig()
-	if err != nil {
-		return toReturn, err
+// handleSignals closes stop on the first SIGINT or SIGTERM, so the run
+// finishes its current request and then stops, and calls cancel on the
+// second to abort in-flight requests.  The returned function stops handling
+// signals.
+func handleSignals(stop chan<- struct{}, cancel context.CancelFunc) func() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			slog.Warn("Received signal, stopping after the current request; signal again to abort", "signal", sig.String())
+			close(stop)
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			slog.Warn("Received second signal, aborting in-flight requests", "signal", sig.String())
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
 	}
-	if err = readConfig(config, &toReturn); err != nil {
-		return toReturn, err
+}
+
+// rootContext returns the context every fetch and publish of the run is
+// bound by, honouring args.OverallTimeout and SIGINT/SIGTERM.
+func rootContext(args types.Arguments) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if args.OverallTimeout > 0 {
+		var tcancel context.CancelFunc
+		ctx, tcancel = context.WithTimeoutCause(ctx, args.OverallTimeout,
+			fmt.Errorf("%w: overall_timeout of %s exceeded", types.ErrTimeout, args.OverallTimeout))
+		pcancel := cancel
+		cancel = func() {
+			tcancel()
+			pcancel()
+		}
+	}
+	stop := make(chan struct{})
+	stopSignals := handleSignals(stop, cancel)
+	return types.WithStop(ctx, stop), func() {
+		stopSignals()
+		cancel()
 	}
+}
 
-	if err = parseDates(&toReturn); err != nil {
-		return toReturn, err
+// setupFetch applies the HTTP debugging, response cache and rate limit
+// settings in args to every LimsRest and SMILE service call.
+func setupFetch(args types.Arguments) error {
+	if args.DebugHTTPDir != "" {
+		if err := fetch.EnableDebug(args.DebugHTTPDir); err != nil {
+			slog.Error("Error enabling HTTP debugging", "error", err)
+			return err
+		}
 	}
-	parseReqIds(&toReturn)
-	parseJSONFile(&toReturn)
-	parsePublisherFile(&toReturn)
-	parseSmileServiceMode(&toReturn)
-	toReturn.CMOReqs = viper.GetBool("cmo_requests_only")
-	return toReturn, nil
+	if args.CacheDir != "" {
+		if err := fetch.EnableCache(args.CacheDir, args.CacheTTL, args.CacheMode, lims.Endpoints...); err != nil {
+			slog.Error("Error enabling response cache", "error", err)
+			return err
+		}
+	}
+	lims.SetRateLimit(args.LimsRateLimit, args.LimsRateBurst)
+	smile.SetRateLimit(args.SmileRateLimit, args.SmileRateBurst)
+	return nil
 }
 
 func run() error {
 	setupOptions()
+	if err := setupLogger(); err != nil {
+		slog.Error("Error configuring logger", "error", err)
+		return err
+	}
+	cmd := pflag.Arg(0)
+	switch cmd {
+	case "", "serve", "retry-failed":
+	case "validate-config":
+		return validateConfig()
+	case "record-fixtures":
+		return recordFixtures()
+	case "fake-lims":
+		return runFakeLims()
+	default:
+		err := fmt.Errorf("Unknown command: %s", cmd)
+		slog.Error("Error parsing arguments", "error", err)
+		return err
+	}
 	args, err := parseArgs()
 	if err != nil {
-		log.Printf("Error parsing arguments: %s", err)
+		slog.Error("Error parsing arguments", "error", err)
+		return err
+	}
+	slog.SetDefault(slog.Default().With("run_id", args.RunId))
+	if viper.GetBool("dump_config") {
+		return dumpConfig(os.Stdout)
+	}
+	if err = setupFetch(args); err != nil {
+		return err
+	}
+	if args.MetricsAddr != "" {
+		metrics.Serve(args.MetricsAddr)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), args.TraceExporter, args.TraceEndpoint)
+	if err != nil {
+		slog.Error("Error configuring tracing", "error", err)
 		return err
 	}
+	defer func() {
+		if terr := shutdownTracing(context.Background()); terr != nil {
+			slog.Error("Error flushing traces", "error", terr)
+		}
+	}()
+	var token string
+	if cmd == "serve" {
+		if token, err = readAPIToken(); err != nil {
+			slog.Error("Error parsing arguments", "error", err)
+			return err
+		}
+	} else if args.Mode() == "" {
+		return nil
+	}
+
+	if err = confirmProfile(args, os.Stdin, os.Stderr, isTerminal(os.Stdin)); err != nil {
+		slog.Error("Error confirming profile", "profile", args.Profile, "error", err)
+		return err
+	}
+
+	var m *messaging.Messaging
+	if !args.DryRun {
+		if m, err = messaging.Connect(args); err != nil {
+			slog.Error("Error connecting to NATS", "error", err)
+			return err
+		}
+		defer closeMessaging(m, args)
+	}
+	if cmd == "serve" {
+		return serveAPI(args, m, token)
+	}
+	ctx, cancel := rootContext(args)
+	defer cancel()
+	if viper.GetBool("progress") {
+		tracker := &progress.Tracker{}
+		ctx = progress.WithTracker(ctx, tracker)
+		defer progress.Report(tracker, progressTerm, 250*time.Millisecond, viper.GetDuration("progress_interval"))()
+	}
+
 	if args.ReqIdMode {
-		if err = lims.FetchRequests(args.ReqIds, args); err != nil {
-			log.Printf("Error fetching requests: %s\n", err)
+		if err = lims.FetchRequests(ctx, m, args.ReqIds, args); err != nil {
+			slog.Error("Error fetching requests", "mode", args.Mode(), "error", err)
 		}
 	} else if args.DateMode {
-		if err = lims.FetchRequestsByDate(args); err != nil {
-			log.Printf("Error fetching requests by date: %s\n", err)
+		if err = lims.FetchRequestsByDate(ctx, m, args); err != nil {
+			slog.Error("Error fetching requests by date", "mode", args.Mode(), "error", err)
+		}
+	} else if args.SampleMode {
+		if err = lims.FetchSamples(ctx, m, args); err != nil {
+			slog.Error("Error fetching samples", "mode", args.Mode(), "error", err)
 		}
 	} else if args.JSONFileMode {
-		if err = lims.FetchRequestFromJSONFile(args); err != nil {
-			log.Printf("Error fetching request from JSON file: %s\n", err)
+		if err = lims.FetchRequestFromJSONFile(ctx, m, args); err != nil {
+			slog.Error("Error fetching request from JSON file", "mode", args.Mode(), "error", err)
 		}
 	} else if args.PublisherFileMode {
-		if err = lims.FetchRequestFromPublisherFile(args); err != nil {
-			log.Printf("Error fetching request from publisher file: %s\n", err)
+		if err = lims.FetchRequestFromPublisherFile(ctx, m, args); err != nil {
+			slog.Error("Error fetching request from publisher file", "mode", args.Mode(), "error", err)
 		}
 	} else if args.SmileServiceMode {
-		if err = smile.FetchRequests(args); err != nil {
-			log.Printf("Error fetching request from smile service: %s\n", err)
+		if err = smile.FetchRequests(ctx, m, args); err != nil {
+			slog.Error("Error fetching request from smile service", "mode", args.Mode(), "error", err)
+		}
+	} else if args.ResumeMode {
+		if err = lims.ResumeRequests(ctx, m, args); err != nil {
+			slog.Error("Error resuming run", "mode", args.Mode(), "error", err)
+		}
+	} else if args.RetryMode {
+		if err = lims.RetryDeadLetters(ctx, m, args); err != nil {
+			slog.Error("Error retrying failed requests", "mode", args.Mode(), "file", args.DeadLetterPath, "error", err)
+		}
+	}
+	if args.MetricsTextfile != "" {
+		if merr := metrics.WriteTextfile(args.MetricsTextfile); merr != nil {
+			slog.Error("Error writing metrics textfile", "path", args.MetricsTextfile, "error", merr)
 		}
 	}
 	return err
 }
 
 func main() {
-	if err := run(); err != nil {
-		os.Exit(1)
-	}
+	os.Exit(exitCode(run()))
 }
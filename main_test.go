@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"testing"
+	"time"
+)
+
+func TestMain_rootContextOverallTimeout(t *testing.T) {
+	ctx, cancel := rootContext(types.Arguments{OverallTimeout: time.Millisecond})
+	defer cancel()
+	<-ctx.Done()
+	if err := context.Cause(ctx); !errors.Is(err, types.ErrTimeout) {
+		t.Errorf("Cause = %v, want %v", err, types.ErrTimeout)
+	}
+}
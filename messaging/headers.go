@@ -0,0 +1,106 @@
+package messaging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/nats-io/nats.go"
+	"net/textproto"
+	"os"
+	"time"
+)
+
+// Provenance headers set on every published message.
+const (
+	HeaderSource      = "Smile-Source"
+	HeaderMode        = "Smile-Mode"
+	HeaderRunId       = "Smile-Run-Id"
+	HeaderRequestId   = "Smile-Request-Id"
+	HeaderSampleId    = "Smile-Sample-Id"
+	HeaderVersion     = "Smile-Publisher-Version"
+	HeaderHost        = "Smile-Publisher-Host"
+	HeaderContentHash = "Smile-Content-Sha256"
+	HeaderType        = "Smile-Proto-Type"
+	HeaderFetchedAt   = "Smile-Fetched-At"
+)
+
+// Sources of published messages, reported in the HeaderSource header.
+const (
+	SourceLims          = "lims"
+	SourceSmile         = "smile"
+	SourceJSONFile      = "json-file"
+	SourcePublisherFile = "publisher-file"
+	SourceAPI           = "api"
+)
+
+// Metadata describes the origin of a single published message.
+type Metadata struct {
+	Source    string    // one of the Source constants
+	RequestId string    // IGO request id, if known
+	SampleId  string    // IGO sample id, for a single sample
+	RunId     string    // overrides the connection's run id when set
+	Type      string    // fully-qualified protobuf message name
+	FetchedAt time.Time // when the content was fetched or read
+}
+
+// WithHeaders is an Option adding static headers to every published message.
+// Keys are canonicalized, so "team" and "Team" name the same header.
+func WithHeaders(hdrs map[string]string) Option {
+	return func(o *Options) {
+		if o.Headers == nil {
+			o.Headers = map[string]string{}
+		}
+		for k, v := range hdrs {
+			o.Headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+		}
+	}
+}
+
+// runHeaders returns the static headers identifying this run of the
+// publisher, merged with the extra headers configured in args.
+func runHeaders(args types.Arguments) map[string]string {
+	hdrs := map[string]string{}
+	for k, v := range args.NatsHeaders {
+		hdrs[k] = v
+	}
+	hdrs[HeaderMode] = args.Mode()
+	hdrs[HeaderRunId] = args.RunId
+	hdrs[HeaderVersion] = types.Version
+	if host, err := os.Hostname(); err == nil {
+		hdrs[HeaderHost] = host
+	}
+	return hdrs
+}
+
+// contentHash returns the hex SHA-256 of data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Messaging) setHeaders(hdr nats.Header, hash string, md Metadata) {
+	for k, v := range m.headers {
+		if v != "" {
+			hdr.Set(k, v)
+		}
+	}
+	hdr.Set(HeaderContentHash, hash)
+	if md.Source != "" {
+		hdr.Set(HeaderSource, md.Source)
+	}
+	if md.RequestId != "" {
+		hdr.Set(HeaderRequestId, md.RequestId)
+	}
+	if md.SampleId != "" {
+		hdr.Set(HeaderSampleId, md.SampleId)
+	}
+	if md.RunId != "" {
+		hdr.Set(HeaderRunId, md.RunId)
+	}
+	if md.Type != "" {
+		hdr.Set(HeaderType, md.Type)
+	}
+	if !md.FetchedAt.IsZero() {
+		hdr.Set(HeaderFetchedAt, md.FetchedAt.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,442 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"github.com/mskcc/smile-message-publisher-go/metrics"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	smsg "github.com/mskcc/smile-messaging-go/messaging"
+	snats "github.com/mskcc/smile-messaging-go/mom/nats"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// flushTimeout bounds how long a core NATS publish waits for the server.
+const flushTimeout = 10 * time.Second
+
+var tracer = otel.Tracer("github.com/mskcc/smile-message-publisher-go/messaging")
+
+// Messaging publishes messages to NATS JetStream.  It implements the
+// smile-messaging-go Messaging interface, and adds PublishContext, which
+// carries message headers, including the trace context of the publishing
+// span, that the interface's Publish cannot.
+type Messaging struct {
+	nc         *nats.Conn
+	js         nats.JetStream // nil when publishing with core NATS
+	headers    map[string]string
+	ackTimeout time.Duration
+	stream     string
+	closeOnce  sync.Once
+	closeErr   error
+	logger     *slog.Logger
+}
+
+var _ smsg.Messaging = (*Messaging)(nil)
+
+// Options for Messaging, extending the smile-messaging-go NATS Options
+type Options struct {
+	snats.Options
+	Token       string
+	NkeySeed    string // path to an NKey seed file
+	Credentials string // path to a JWT .creds file
+	Headers     map[string]string
+	CoreNats    bool          // publish without JetStream acknowledgements
+	AckTimeout  time.Duration // how long to wait for a JetStream PubAck
+	Stream      string        // stream expected to acknowledge each message
+	Logger      *slog.Logger  // logs connection events; slog.Default() if nil
+}
+
+// An Option is a function operating on the Messaging Options
+type Option func(*Options)
+
+// WithTLS is an Option to enable a TLS channel
+func WithTLS(certPath, keyPath, userId, pw string) Option {
+	return func(o *Options) {
+		snats.WithTLS(certPath, keyPath, userId, pw)(&o.Options)
+	}
+}
+
+// WithJetStream is an Option configuring JetStream publishing.  Each publish
+// waits up to ackTimeout (the nats.go default when zero) for a PubAck, from
+// stream if it is not empty.
+func WithJetStream(ackTimeout time.Duration, stream string) Option {
+	return func(o *Options) {
+		o.CoreNats = false
+		o.AckTimeout = ackTimeout
+		o.Stream = stream
+	}
+}
+
+// WithCoreNats is an Option to publish with core NATS, without waiting for
+// JetStream acknowledgements or deduplicating messages.
+func WithCoreNats() Option {
+	return func(o *Options) {
+		o.CoreNats = true
+	}
+}
+
+// WithUserInfo is an Option to authenticate with a user and password
+// without TLS
+func WithUserInfo(userId, pw string) Option {
+	return func(o *Options) {
+		o.UserId = userId
+		o.Password = pw
+	}
+}
+
+// WithToken is an Option to authenticate with a token
+func WithToken(token string) Option {
+	return func(o *Options) {
+		o.Token = token
+	}
+}
+
+// WithNkeySeed is an Option to authenticate with the NKey seed in seedPath
+func WithNkeySeed(seedPath string) Option {
+	return func(o *Options) {
+		o.NkeySeed = seedPath
+	}
+}
+
+// WithCredentials is an Option to authenticate with the JWT and seed in a
+// .creds file
+func WithCredentials(credsPath string) Option {
+	return func(o *Options) {
+		o.Credentials = credsPath
+	}
+}
+
+// WithLogger is an Option to log connection events, such as disconnects and
+// reconnects, with l rather than slog.Default()
+func WithLogger(l *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+func NewMessaging(url string, opts ...Option) (*Messaging, error) {
+	var options Options
+	for _, o := range opts {
+		o(&options)
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var natsOpts []nats.Option
+	if options.UseTLS {
+		natsOpts = append(natsOpts, nats.ClientCert(options.TLSCertPath, options.TLSKeyPath))
+	}
+	if options.UserId != "" {
+		natsOpts = append(natsOpts, nats.UserInfo(options.UserId, options.Password))
+	}
+	if options.Token != "" {
+		natsOpts = append(natsOpts, nats.Token(options.Token))
+	}
+	if options.NkeySeed != "" {
+		opt, err := nats.NkeyOptionFromSeed(options.NkeySeed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: loading NKey seed: %s", types.ErrPublish, err)
+		}
+		natsOpts = append(natsOpts, opt)
+	}
+	if options.Credentials != "" {
+		natsOpts = append(natsOpts, nats.UserCredentials(options.Credentials))
+	}
+	natsOpts = append(natsOpts,
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}))
+	nc, err := nats.Connect(url, natsOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: connecting to NATS at %s: %s", types.ErrPublish, url, err)
+	}
+	m := &Messaging{nc: nc, headers: options.Headers, ackTimeout: options.AckTimeout, stream: options.Stream,
+		logger: logger}
+	if !options.CoreNats {
+		if m.js, err = nc.JetStream(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("%w: creating JetStream context: %s", types.ErrPublish, err)
+		}
+	}
+	return m, nil
+}
+
+// Connect creates a Messaging from the NATS settings in args, authenticating
+// as selected by args.NatsAuth and stamping every message with headers
+// identifying this run.
+func Connect(args types.Arguments) (*Messaging, error) {
+	pubOpt := WithJetStream(args.NatsAckTimeout, args.NatsStream)
+	if !args.NatsJetStream {
+		pubOpt = WithCoreNats()
+	}
+	var authOpt Option
+	switch args.NatsAuth {
+	case types.NatsAuthPlain:
+		authOpt = WithUserInfo(args.NatsConName, args.NatsConPw)
+	case types.NatsAuthToken:
+		authOpt = WithToken(args.NatsToken)
+	case types.NatsAuthNkey:
+		authOpt = WithNkeySeed(args.NatsNkeySeedPath)
+	case types.NatsAuthCreds:
+		authOpt = WithCredentials(args.NatsCredsPath)
+	default:
+		authOpt = WithTLS(args.NatsTrustPath, args.NatsKeyPath, args.NatsConName, args.NatsConPw)
+	}
+	return NewMessaging(args.NatsUrl, authOpt, WithHeaders(runHeaders(args)), pubOpt)
+}
+
+// PublishContext sends data to subj with provenance headers describing md,
+// and the trace context of ctx.  With JetStream the message id is derived from the
+// request id and content hash, so the server discards republished duplicates
+// within its dedup window, and a missing PubAck is a failure.  Failures are
+// reported as a *types.PublishError.
+func (m *Messaging) PublishContext(ctx context.Context, subj string, data []byte, md Metadata) error {
+	ctx, span := tracer.Start(ctx, "publish "+subj, trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subj),
+			attribute.Int("messaging.message.body.size", len(data))))
+	defer span.End()
+
+	msg := nats.NewMsg(subj)
+	msg.Data = data
+	msg.Header.Add("Nats-Msg-Subject", subj)
+	hash := contentHash(data)
+	m.setHeaders(msg.Header, hash, md)
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+
+	var err error
+	if m.js != nil {
+		err = m.publishJetStream(ctx, msg, MsgId(md.RequestId, hash))
+	} else if err = m.nc.PublishMsg(msg); err == nil {
+		err = m.nc.FlushTimeout(flushTimeout)
+	}
+	metrics.ObservePublish(subj, len(data), err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return &types.PublishError{Topic: subj, Err: err}
+	}
+	return nil
+}
+
+// Publish sends data to subj with only the headers set for every message,
+// implementing smile-messaging-go's Messaging.
+func (m *Messaging) Publish(subj string, data []byte) error {
+	return m.PublishContext(context.Background(), subj, data, Metadata{})
+}
+
+// Subscribe registers mh for the messages on subj through the JetStream
+// durable consumer con, implementing smile-messaging-go's Messaging.
+func (m *Messaging) Subscribe(con, subj string, mh smsg.MsgHandler) error {
+	js := m.js
+	if js == nil {
+		var err error
+		if js, err = m.nc.JetStream(); err != nil {
+			return err
+		}
+	}
+	_, err := js.Subscribe(subj, func(msg *nats.Msg) {
+		mh(&smsg.Msg{Subject: msg.Subject, Data: msg.Data})
+	}, nats.Durable(con))
+	return err
+}
+
+// Shutdown closes the connection as Close does, implementing
+// smile-messaging-go's Messaging.
+func (m *Messaging) Shutdown() {
+	if err := m.Close(flushTimeout); err != nil {
+		m.logger.Warn("Failure to close NATS connection", "error", err)
+	}
+}
+
+func (m *Messaging) publishJetStream(ctx context.Context, msg *nats.Msg, id string) error {
+	opts := []nats.PubOpt{nats.MsgId(id)}
+	if m.ackTimeout > 0 {
+		opts = append(opts, nats.AckWait(m.ackTimeout))
+	}
+	if m.stream != "" {
+		opts = append(opts, nats.ExpectStream(m.stream))
+	}
+	ack, err := m.js.PublishMsg(msg, opts...)
+	if err != nil {
+		return err
+	}
+	if ack.Duplicate {
+		metrics.ObserveDuplicate(msg.Subject)
+		types.Logger(ctx).Info("Message discarded by server as a duplicate", "topic", msg.Subject, "msg_id", id,
+			"stream", ack.Stream, "seq", ack.Sequence)
+	}
+	return nil
+}
+
+// MsgId returns the JetStream message id for content with the given hash
+// published for reqId.
+func MsgId(reqId, hash string) string {
+	if reqId == "" {
+		return hash
+	}
+	return reqId + ":" + hash
+}
+
+// Close flushes any buffered messages to the server, then drains and closes
+// the connection, waiting at most timeout for each step.  It is safe to call
+// more than once, e.g. from a signal handler and on normal exit.
+func (m *Messaging) Close(timeout time.Duration) error {
+	m.closeOnce.Do(func() { m.closeErr = m.close(timeout) })
+	return m.closeErr
+}
+
+func (m *Messaging) close(timeout time.Duration) error {
+	ferr := m.nc.FlushTimeout(timeout)
+	closed := make(chan struct{})
+	m.nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	if err := m.nc.Drain(); err != nil {
+		m.nc.Close()
+		return err
+	}
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		m.nc.Close()
+		return fmt.Errorf("timed out draining NATS connection after %s", timeout)
+	}
+	if ferr != nil {
+		return fmt.Errorf("flushing NATS connection: %w", ferr)
+	}
+	return nil
+}
+
+// Serve subscribes to subj in queue group queue, so several publishers can
+// share the load, and replies to each message with the result of handle.
+// At most limit messages are handled concurrently; further messages are
+// replied to with busy at once, so their senders can retry elsewhere.  The
+// returned function unsubscribes and waits, until ctx is done, for messages
+// being handled.
+func (m *Messaging) Serve(subj, queue string, limit int, busy []byte, handle func(data []byte) []byte) (func(ctx context.Context) error, error) {
+	h := newServedHandler(limit, busy, handle)
+	sub, err := m.nc.QueueSubscribe(subj, queue, func(msg *nats.Msg) {
+		h.dispatch(msg.Data, func(reply []byte) {
+			if msg.Reply == "" {
+				return
+			}
+			if err := msg.Respond(reply); err != nil {
+				m.logger.Error("Failure to reply to command", "subject", subj, "error", err)
+			}
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("subscribing to %s: %w", subj, err)
+	}
+	return func(ctx context.Context) error {
+		err := sub.Unsubscribe()
+		if werr := h.stop(ctx); werr != nil {
+			return werr
+		}
+		return err
+	}, nil
+}
+
+// servedHandler runs the handler of Serve for each message, at most
+// cap(sem) at a time.
+type servedHandler struct {
+	handle  func(data []byte) []byte
+	busy    []byte
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newServedHandler(limit int, busy []byte, handle func(data []byte) []byte) *servedHandler {
+	return &servedHandler{handle: handle, busy: busy, sem: make(chan struct{}, limit)}
+}
+
+// dispatch handles data in a new goroutine, passing the reply to respond,
+// or responds with busy if the limit is reached.  Once stopped, messages are
+// dropped.
+func (h *servedHandler) dispatch(data []byte, respond func(reply []byte)) {
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	select {
+	case h.sem <- struct{}{}:
+	default:
+		h.mu.Unlock()
+		respond(h.busy)
+		return
+	}
+	h.wg.Add(1)
+	h.mu.Unlock()
+	go func() {
+		defer h.wg.Done()
+		reply := h.handle(data)
+		<-h.sem
+		respond(reply)
+	}()
+}
+
+// stop drops further messages and waits, until ctx is done, for those being
+// handled.
+func (h *servedHandler) stop(ctx context.Context) error {
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status describes the state of the NATS connection, e.g. CONNECTED or
+// RECONNECTING.
+func (m *Messaging) Status() string {
+	return m.nc.Status().String()
+}
+
+// Connected reports whether the NATS connection is currently up.
+func (m *Messaging) Connected() bool {
+	return m.nc.IsConnected()
+}
+
+// HeaderCarrier adapts nats.Header to propagation.TextMapCarrier so trace
+// context can be injected into, and extracted from, message headers.
+type HeaderCarrier nats.Header
+
+func (c HeaderCarrier) Get(key string) string {
+	if v := c[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	c[key] = []string{value}
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
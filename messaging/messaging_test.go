@@ -0,0 +1,92 @@
+package messaging
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+func TestMessaging_HeaderCarrierRoundTrip(t *testing.T) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	hdr := nats.Header{}
+	prop := propagation.TraceContext{}
+	prop.Inject(ctx, HeaderCarrier(hdr))
+	if got := hdr.Get("traceparent"); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("unexpected traceparent header: %q", got)
+	}
+
+	extracted := trace.SpanContextFromContext(prop.Extract(context.Background(), HeaderCarrier(hdr)))
+	if extracted.TraceID() != sc.TraceID() || extracted.SpanID() != sc.SpanID() {
+		t.Errorf("expected %v, got %v", sc, extracted)
+	}
+}
+
+func TestMessaging_setHeaders(t *testing.T) {
+	var opts Options
+	WithHeaders(map[string]string{"team": "smile", HeaderRunId: "20261018T000000Z-0a1b2c3d"})(&opts)
+	m := &Messaging{headers: opts.Headers}
+	hdr := nats.Header{}
+	fetchedAt := time.Date(2022, 7, 21, 10, 30, 0, 0, time.UTC)
+	m.setHeaders(hdr, contentHash([]byte("payload")), Metadata{Source: SourceLims, RequestId: "13370", Type: "igo.RequestWithManifests", FetchedAt: fetchedAt})
+
+	expected := map[string]string{
+		"Team":            "smile",
+		HeaderRunId:       "20261018T000000Z-0a1b2c3d",
+		HeaderSource:      SourceLims,
+		HeaderRequestId:   "13370",
+		HeaderType:        "igo.RequestWithManifests",
+		HeaderFetchedAt:   "2022-07-21T10:30:00Z",
+		HeaderContentHash: "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5",
+	}
+	for k, v := range expected {
+		if got := hdr.Get(k); got != v {
+			t.Errorf("header %s: expected %q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestMessaging_servedHandlerRepliesBusy(t *testing.T) {
+	release := make(chan struct{})
+	h := newServedHandler(1, []byte("busy"), func(data []byte) []byte {
+		<-release
+		return data
+	})
+	replies := make(chan string, 3)
+	respond := func(reply []byte) { replies <- string(reply) }
+
+	h.dispatch([]byte("first"), respond)
+	h.dispatch([]byte("second"), respond)
+	if got := <-replies; got != "busy" {
+		t.Errorf("Reply while at the limit = %q, want busy", got)
+	}
+	close(release)
+	if got := <-replies; got != "first" {
+		t.Errorf("Reply = %q, want first", got)
+	}
+
+	// the slot is free again once the first message is handled
+	h.dispatch([]byte("third"), respond)
+	if got := <-replies; got != "third" {
+		t.Errorf("Reply = %q, want third", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h.dispatch([]byte("fourth"), respond)
+	select {
+	case got := <-replies:
+		t.Errorf("Reply %q after stop", got)
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Registry holds every metric exported by the publisher.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smile_publisher",
+		Name:      "http_requests_total",
+		Help:      "HTTP calls to LimsRest and the SMILE service by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "smile_publisher",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP calls to LimsRest and the SMILE service by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint"})
+	publishAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smile_publisher",
+		Name:      "publish_attempts_total",
+		Help:      "Messages the publisher attempted to publish by topic.",
+	}, []string{"topic"})
+	publishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smile_publisher",
+		Name:      "publish_failures_total",
+		Help:      "Messages that failed to publish by topic.",
+	}, []string{"topic"})
+	publishDuplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smile_publisher",
+		Name:      "publish_duplicates_total",
+		Help:      "Messages acknowledged by JetStream as duplicates of an earlier publish, by topic.",
+	}, []string{"topic"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smile_publisher",
+		Name:      "cache_lookups_total",
+		Help:      "Response cache lookups by endpoint and result (hit, miss, revalidated).",
+	}, []string{"endpoint", "result"})
+	messageSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "smile_publisher",
+		Name:      "message_size_bytes",
+		Help:      "Size of published messages by topic.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"topic"})
+)
+
+func init() {
+	Registry.MustRegister(httpRequests, httpDuration, publishAttempts, publishFailures, publishDuplicates, cacheLookups, messageSize)
+}
+
+// ObserveHTTP records an HTTP call to endpoint.  A status of 0 means no
+// response was received.
+func ObserveHTTP(endpoint string, status int, d time.Duration) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	httpRequests.WithLabelValues(endpoint, code).Inc()
+	httpDuration.WithLabelValues(endpoint).Observe(d.Seconds())
+}
+
+// ObservePublish records an attempt to publish size bytes to topic.
+func ObservePublish(topic string, size int, err error) {
+	publishAttempts.WithLabelValues(topic).Inc()
+	messageSize.WithLabelValues(topic).Observe(float64(size))
+	if err != nil {
+		publishFailures.WithLabelValues(topic).Inc()
+	}
+}
+
+// ObserveDuplicate records a publish to topic discarded by JetStream
+// deduplication.
+func ObserveDuplicate(topic string) {
+	publishDuplicates.WithLabelValues(topic).Inc()
+}
+
+// ObserveCache records a response cache lookup for endpoint with the given
+// result: hit, miss or revalidated.
+func ObserveCache(endpoint, result string) {
+	cacheLookups.WithLabelValues(endpoint, result).Inc()
+}
+
+// Handler serves the metrics in Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serve exposes the metrics at /metrics on addr in the background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
+
+// WriteTextfile writes the metrics in Registry to path for collection by
+// the node_exporter textfile collector or a Pushgateway-compatible agent.
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
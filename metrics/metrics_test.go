@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_WriteTextfile(t *testing.T) {
+	ObserveHTTP("getSampleManifest", 200, 120*time.Millisecond)
+	ObservePublish("igo.new-request", 2048, nil)
+	ObservePublish("igo.new-request", 4096, errors.New("nats: timeout"))
+
+	path := filepath.Join(t.TempDir(), "smile_publisher.prom")
+	if err := WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`smile_publisher_http_requests_total{endpoint="getSampleManifest",status="200"} 1`,
+		`smile_publisher_publish_attempts_total{topic="igo.new-request"} 2`,
+		`smile_publisher_publish_failures_total{topic="igo.new-request"} 1`,
+		`smile_publisher_message_size_bytes_count{topic="igo.new-request"} 2`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
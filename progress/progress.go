@@ -0,0 +1,198 @@
+// Package progress tracks the progress of a run through its requests and
+// reports it, either as a live status line on a terminal or as periodic log
+// lines.
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tracker counts the requests and samples of a run.  A nil *Tracker
+// ignores every call, so fetchers need not check for one.
+type Tracker struct {
+	mu      sync.Mutex
+	start   time.Time
+	total   int
+	done    int
+	failed  int
+	samples int
+}
+
+// Snapshot is the progress of a run at a point in time.
+type Snapshot struct {
+	Total   int
+	Done    int // requests attempted, including failures
+	Failed  int
+	Samples int
+	Elapsed time.Duration
+	Rate    float64       // requests per minute
+	ETA     time.Duration // zero until the first request is done
+}
+
+type trackerKey struct{}
+
+// WithTracker returns a copy of ctx carrying t.
+func WithTracker(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// From returns the Tracker carried by ctx, or nil.
+func From(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// Start adds n requests to the run's total, starting the clock on the
+// first call.
+func (t *Tracker) Start(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	t.total += n
+}
+
+// Request counts a request attempted, failed if err is not nil.
+func (t *Tracker) Request(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done++
+	if err != nil {
+		t.failed++
+	}
+}
+
+// Sample counts a sample manifest fetched.
+func (t *Tracker) Sample() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples++
+}
+
+// Snapshot returns the progress so far.
+func (t *Tracker) Snapshot() Snapshot {
+	if t == nil {
+		return Snapshot{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Snapshot{Total: t.total, Done: t.done, Failed: t.failed, Samples: t.samples}
+	if t.start.IsZero() {
+		return s
+	}
+	s.Elapsed = time.Since(t.start)
+	if t.done > 0 {
+		per := s.Elapsed / time.Duration(t.done)
+		s.Rate = float64(time.Minute) / float64(per)
+		s.ETA = per * time.Duration(t.total-t.done)
+	}
+	return s
+}
+
+// eta formats s.ETA, or "-" while it is unknown.
+func (s Snapshot) eta() string {
+	if s.Done == 0 {
+		return "-"
+	}
+	return s.ETA.Round(time.Second).String()
+}
+
+// String formats s for a status line, e.g.
+// "12/40 requests, 96 samples, 1 failed, 3.2 req/min, ETA 8m45s".
+func (s Snapshot) String() string {
+	return fmt.Sprintf("%d/%d requests, %d samples, %d failed, %.1f req/min, ETA %s",
+		s.Done, s.Total, s.Samples, s.Failed, s.Rate, s.eta())
+}
+
+// Terminal writes log output to a terminal, keeping a status line below it.
+type Terminal struct {
+	mu     sync.Mutex
+	w      io.Writer
+	status string
+}
+
+// NewTerminal returns a Terminal writing to w, which must be a terminal.
+func NewTerminal(w io.Writer) *Terminal {
+	return &Terminal{w: w}
+}
+
+// clearLine returns the cursor to the start of the line and erases it.
+const clearLine = "\r\033[K"
+
+// Write writes p, a whole log line, above the status line.
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status == "" {
+		return t.w.Write(p)
+	}
+	io.WriteString(t.w, clearLine)
+	n, err := t.w.Write(p)
+	io.WriteString(t.w, t.status)
+	return n, err
+}
+
+// SetStatus replaces the status line; an empty status erases it.
+func (t *Terminal) SetStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.w, clearLine+status)
+	t.status = status
+}
+
+// Report reports the progress of t until the returned function is called:
+// on term, if not nil, redrawing its status line every refresh, otherwise
+// logging it every interval.  The returned function reports the final
+// progress once more.
+func Report(t *Tracker, term *Terminal, refresh, interval time.Duration) func() {
+	every := interval
+	report := func() {
+		s := t.Snapshot()
+		slog.Info("Progress", "done", s.Done, "total", s.Total, "samples", s.Samples, "failures", s.Failed,
+			"requests_per_minute", fmt.Sprintf("%.1f", s.Rate), "eta", s.eta())
+	}
+	if term != nil {
+		every = refresh
+		report = func() { term.SetStatus(t.Snapshot().String()) }
+	}
+	ticker := time.NewTicker(every)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+		if term != nil {
+			term.SetStatus("")
+			fmt.Fprintln(term, "Progress: "+t.Snapshot().String())
+			return
+		}
+		report()
+	}
+}
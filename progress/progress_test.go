@@ -0,0 +1,54 @@
+package progress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTracker_Snapshot(t *testing.T) {
+	// fetchers call a missing tracker unchecked
+	From(context.Background()).Start(1)
+	From(context.Background()).Request(nil)
+	if s := From(context.Background()).Snapshot(); s != (Snapshot{}) {
+		t.Errorf("Unexpected snapshot of a missing tracker %+v", s)
+	}
+
+	tr := &Tracker{}
+	ctx := WithTracker(context.Background(), tr)
+	if s := tr.Snapshot(); s.String() != "0/0 requests, 0 samples, 0 failed, 0.0 req/min, ETA -" {
+		t.Errorf("Unexpected initial snapshot %q", s)
+	}
+	From(ctx).Start(4)
+	From(ctx).Sample()
+	From(ctx).Sample()
+	From(ctx).Request(nil)
+	From(ctx).Request(errors.New("failed"))
+
+	s := tr.Snapshot()
+	if s.Total != 4 || s.Done != 2 || s.Failed != 1 || s.Samples != 2 || s.Rate <= 0 {
+		t.Errorf("Unexpected snapshot %+v", s)
+	}
+	// the remaining 2 requests take as long as the first 2 did
+	if d := s.ETA - s.Elapsed; d < -s.Elapsed/10 || d > s.Elapsed/10 {
+		t.Errorf("ETA %s, elapsed %s", s.ETA, s.Elapsed)
+	}
+}
+
+func TestTerminal_KeepsStatusBelowLogs(t *testing.T) {
+	var buf bytes.Buffer
+	term := NewTerminal(&buf)
+	term.Write([]byte("first\n"))
+	term.SetStatus("1/2 requests")
+	term.Write([]byte("second\n"))
+	term.SetStatus("")
+	term.Write([]byte("third\n"))
+
+	want := strings.Join([]string{"first\n", clearLine, "1/2 requests", clearLine, "second\n", "1/2 requests",
+		clearLine, "third\n"}, "")
+	if buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,180 @@
+// Package publisher is a library interface to the fetch and publish steps
+// used by the smile-message-publisher command.  Every call takes a context
+// and returns its result or error.  Unlike the command it does not log
+// unless given a logger with WithLogger.
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/lims"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/smile"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Errors returned when a call needs a backend the Client was not given.
+var (
+	ErrNoLims      = errors.New("LimsRest is not configured")
+	ErrNoSmile     = errors.New("SMILE request service is not configured")
+	ErrNoMessaging = errors.New("NATS messaging is not configured")
+)
+
+// Client fetches requests from LimsRest or the SMILE request service and
+// publishes them to NATS.  A Client is safe for concurrent use.
+type Client struct {
+	args   types.Arguments
+	m      *messaging.Messaging
+	topic  string
+	logger *slog.Logger
+}
+
+// An Option configures a Client.
+type Option func(*Client)
+
+// WithLims is an Option to fetch from the LimsRest instance at host.
+func WithLims(host, user, pw string) Option {
+	return func(c *Client) {
+		c.args.LimsHost = host
+		c.args.LimsUser = user
+		c.args.LimsPW = pw
+	}
+}
+
+// WithSmile is an Option to fetch from the SMILE request service;
+// requestUrl is prefixed to the request id.
+func WithSmile(requestUrl string) Option {
+	return func(c *Client) {
+		c.args.SmileRequestUrl = requestUrl
+	}
+}
+
+// WithMessaging is an Option to publish with m, to topic unless a Publish
+// call names another.  The caller remains responsible for closing m, and
+// chooses how it logs connection events with messaging.WithLogger.
+func WithMessaging(m *messaging.Messaging, topic string) Option {
+	return func(c *Client) {
+		c.m = m
+		c.topic = topic
+	}
+}
+
+// WithLogger is an Option to log with l, e.g. HTTP requests at debug level
+// and messages the server discards as duplicates.  Nothing is logged
+// without it.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// New returns a Client configured by opts.
+func New(opts ...Option) *Client {
+	c := &Client{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// FetchLimsRequest fetches a request and its sample manifests from LimsRest.
+// If some manifests cannot be fetched the request is returned without those
+// samples, along with an error joining a *lims.SampleError for each.
+func (c *Client) FetchLimsRequest(ctx context.Context, reqId string) (*igo.RequestWithManifests, error) {
+	if c.args.LimsHost == "" {
+		return nil, ErrNoLims
+	}
+	return lims.FetchRequestWithManifests(types.WithLogger(ctx, c.logger), reqId, c.args)
+}
+
+// FetchLimsDeliveries returns the ids of requests delivered by IGO between
+// start and end.
+func (c *Client) FetchLimsDeliveries(ctx context.Context, start, end time.Time) ([]string, error) {
+	if c.args.LimsHost == "" {
+		return nil, ErrNoLims
+	}
+	args := c.args
+	args.StartDate = start
+	args.EndDate = end
+	return lims.FetchDeliveries(types.WithLogger(ctx, c.logger), args)
+}
+
+// FetchSmileRequest fetches a request with its sample manifests from the
+// SMILE request service.
+func (c *Client) FetchSmileRequest(ctx context.Context, reqId string) (*igo.RequestWithManifests, error) {
+	if c.args.SmileRequestUrl == "" {
+		return nil, ErrNoSmile
+	}
+	return smile.FetchRequest(types.WithLogger(ctx, c.logger), reqId, c.args)
+}
+
+// PublishResult describes a published message.
+type PublishResult struct {
+	Topic     string
+	RequestId string
+	Size      int // serialized message size in bytes
+}
+
+type publishOptions struct {
+	topic     string
+	source    string
+	fetchedAt time.Time
+}
+
+// A PublishOption configures a single Publish call.
+type PublishOption func(*publishOptions)
+
+// ToTopic is a PublishOption to publish to topic instead of the Client's
+// default.
+func ToTopic(topic string) PublishOption {
+	return func(o *publishOptions) {
+		o.topic = topic
+	}
+}
+
+// FromSource is a PublishOption setting the Smile-Source header, one of the
+// messaging Source constants.  It defaults to messaging.SourceLims.
+func FromSource(source string) PublishOption {
+	return func(o *publishOptions) {
+		o.source = source
+	}
+}
+
+// FetchedAt is a PublishOption setting when the content was fetched.  It
+// defaults to the time of the Publish call.
+func FetchedAt(t time.Time) PublishOption {
+	return func(o *publishOptions) {
+		o.fetchedAt = t
+	}
+}
+
+// Publish serializes rwm and publishes it.  Failures to publish are
+// reported as a *types.PublishError.
+func (c *Client) Publish(ctx context.Context, rwm *igo.RequestWithManifests, opts ...PublishOption) (*PublishResult, error) {
+	if c.m == nil {
+		return nil, ErrNoMessaging
+	}
+	o := publishOptions{topic: c.topic, source: messaging.SourceLims, fetchedAt: time.Now()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.topic == "" {
+		return nil, errors.New("No topic to publish to")
+	}
+	out, err := proto.Marshal(rwm)
+	if err != nil {
+		return nil, fmt.Errorf("serializing request: %w", err)
+	}
+	reqId := rwm.GetRequestId()
+	md := messaging.Metadata{Source: o.source, RequestId: reqId, Type: string(proto.MessageName(rwm)), FetchedAt: o.fetchedAt}
+	if err := c.m.PublishContext(types.WithLogger(ctx, c.logger), o.topic, out, md); err != nil {
+		return nil, err
+	}
+	return &PublishResult{Topic: o.topic, RequestId: reqId, Size: len(out)}, nil
+}
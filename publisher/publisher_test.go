@@ -0,0 +1,71 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchSmileRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/request/05274_C" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"requestId":"05274_C","isCmoRequest":true}`))
+	}))
+	defer srv.Close()
+
+	c := New(WithSmile(srv.URL + "/request/"))
+	rwm, err := c.FetchSmileRequest(context.Background(), "05274_C")
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if rwm.RequestId != "05274_C" || !rwm.IsCmoRequest {
+		t.Errorf("Unexpected request: %v", rwm)
+	}
+}
+
+func TestUnconfiguredBackends(t *testing.T) {
+	c := New()
+	ctx := context.Background()
+	if _, err := c.FetchLimsRequest(ctx, "05274_C"); !errors.Is(err, ErrNoLims) {
+		t.Errorf("FetchLimsRequest error = %v, want %v", err, ErrNoLims)
+	}
+	if _, err := c.FetchSmileRequest(ctx, "05274_C"); !errors.Is(err, ErrNoSmile) {
+		t.Errorf("FetchSmileRequest error = %v, want %v", err, ErrNoSmile)
+	}
+	if _, err := c.Publish(ctx, nil); !errors.Is(err, ErrNoMessaging) {
+		t.Errorf("Publish error = %v, want %v", err, ErrNoMessaging)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"requestId":"05274_C"}`))
+	}))
+	defer srv.Close()
+	var def, buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&def, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(saved)
+
+	if _, err := New(WithSmile(srv.URL+"/")).FetchSmileRequest(context.Background(), "05274_C"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if def.Len() != 0 {
+		t.Errorf("Logged without a logger:\n%s", def.String())
+	}
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if _, err := New(WithSmile(srv.URL+"/"), WithLogger(l)).FetchSmileRequest(context.Background(), "05274_C"); err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if !strings.Contains(buf.String(), "HTTP request completed") || def.Len() != 0 {
+		t.Errorf("Unexpected logs %q, default %q", buf.String(), def.String())
+	}
+}
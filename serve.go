@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-message-publisher-go/api"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// apiShutdownTimeout bounds how long the serve command waits for runs in
+// progress after a signal before cancelling them.
+const apiShutdownTimeout = 30 * time.Second
+
+// readAPIToken returns the bearer token API callers must present.
+func readAPIToken() (string, error) {
+	token := viper.GetString("api.token")
+	if token == "" {
+		return "", errors.New("Missing api.token property in config file")
+	}
+	return token, nil
+}
+
+// serveAPI implements the serve command, publishing on demand through the
+// REST API on --api_addr, and commands received on nats.command_subject,
+// until SIGINT or SIGTERM.  Runs in progress are
+// given apiShutdownTimeout to finish before they are cancelled.
+func serveAPI(args types.Arguments, m *messaging.Messaging, token string) error {
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	defer cancelRuns()
+	srv := api.New(runCtx, args, m, token)
+	addr := viper.GetString("api_addr")
+	hs := &http.Server{Addr: addr, Handler: srv.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- hs.ListenAndServe() }()
+	slog.Info("Serving publish API", "addr", addr)
+	stopCommands := func(context.Context) error { return nil }
+	if args.NatsCommandSubj != "" {
+		var err error
+		if stopCommands, err = m.Serve(args.NatsCommandSubj, args.NatsCommandQueue, args.NatsCommandLimit, api.BusyReply, srv.HandleCommand); err != nil {
+			slog.Error("Error subscribing to command subject", "subject", args.NatsCommandSubj, "error", err)
+			hs.Close()
+			return err
+		}
+		slog.Info("Accepting commands", "subject", args.NatsCommandSubj, "queue", args.NatsCommandQueue,
+			"limit", args.NatsCommandLimit)
+	}
+	select {
+	case err := <-errc:
+		slog.Error("Publish API stopped", "error", err)
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down publish API, waiting for runs in progress", "timeout", apiShutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	// stop taking commands at once; each replies when its run finishes
+	cmdsDone := make(chan error, 1)
+	go func() { cmdsDone <- stopCommands(sctx) }()
+	hs.Shutdown(sctx)
+	if !srv.Wait(sctx) {
+		slog.Warn("Cancelling runs still in progress")
+		cancelRuns()
+		srv.Wait(context.Background())
+	}
+	if err := <-cmdsDone; err != nil {
+		slog.Warn("Error stopping command subscription", "error", err)
+	}
+	return nil
+}
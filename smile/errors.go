@@ -0,0 +1,16 @@
+package smile
+
+import "github.com/mskcc/smile-message-publisher-go/types"
+
+// Error classes returned by this package, see the types package for details.
+var (
+	ErrNotFound     = types.ErrNotFound
+	ErrUnauthorized = types.ErrUnauthorized
+	ErrTimeout      = types.ErrTimeout
+	ErrDecode       = types.ErrDecode
+	ErrPublish      = types.ErrPublish
+	ErrInterrupted  = types.ErrInterrupted
+)
+
+type FetchError = types.FetchError
+type PublishError = types.PublishError
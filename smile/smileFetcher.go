@@ -2,74 +2,118 @@ package smile
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/messaging"
+	"github.com/mskcc/smile-message-publisher-go/progress"
 	"github.com/mskcc/smile-message-publisher-go/types"
-	sm "github.com/mskcc/smile-messaging-go/mom/nats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 )
 
-func FetchRequests(args types.Arguments) error {
-	m, err := sm.NewMessaging(args.NatsUrl, sm.WithTLS(args.NatsTrustPath, args.NatsKeyPath, args.NatsConName, args.NatsConPw))
-	if err != nil {
-		return nil
-	}
+var tracer = otel.Tracer("github.com/mskcc/smile-message-publisher-go/smile")
+
+// limiter throttles calls to the SMILE request service, unlimited by default.
+var limiter = rate.NewLimiter(rate.Inf, 1)
+
+// SetRateLimit limits calls to the SMILE request service, across all
+// goroutines, to rps per second with bursts of up to burst.  An rps of zero
+// removes the limit.
+func SetRateLimit(rps float64, burst int) {
+	limiter.SetLimit(fetch.Limit(rps))
+	limiter.SetBurst(burst)
+}
+
+// FetchRequests fetches and republishes each of args.ReqIds in turn.  Once
+// ctx is cancelled or a stop is requested (see types.WithStop) no further
+// requests are started.
+func FetchRequests(ctx context.Context, m *messaging.Messaging, args types.Arguments) error {
+	logger := types.Logger(ctx).With("mode", args.Mode())
+	pt := progress.From(ctx)
+	pt.Start(len(args.ReqIds))
+	var errs []error
 	lc := 0
 	for _, id := range args.ReqIds {
-		lc++
-		log.Printf("Attempting to fetch and publish %d of %d request(s): %s\n", lc, len(args.ReqIds), id)
-		req, err := fetchRequest(id, args)
-		if err != nil {
-			log.Printf("Failure to fetch request %s: %s\n", id, err)
-			continue
-		}
-		if args.CMOReqs && !req.IsCmoRequest {
-			log.Printf("Skipping non-cmo request %s as 'cmo_requests_only (-c)' flag is set\n", id)
-			continue
+		if err := types.Stopping(ctx); err != nil {
+			logger.Warn("Stopping before remaining request(s)", "remaining", len(args.ReqIds)-lc, "reason", err)
+			errs = append(errs, fmt.Errorf("%d request(s) not attempted: %w", len(args.ReqIds)-lc, err))
+			break
 		}
-		out, err := proto.Marshal(&req)
+		lc++
+		rl := logger.With("request_id", id)
+		rl.Info("Attempting to fetch and publish request", "index", lc, "total", len(args.ReqIds))
+		err := fetchAndPublishRequest(ctx, m, id, args, rl)
+		pt.Request(err)
 		if err != nil {
-			log.Printf("Failure to serialize request %s: %s\n", id, err)
-			continue
-		}
-		if err = m.Publish(args.SmilePubTop, out); err != nil {
-			log.Printf("Failure to publish request %s: %s\n", id, err)
-			continue
+			errs = append(errs, fmt.Errorf("request %s: %w", id, err))
 		}
-		log.Printf("Successfully fetched and published request %s\n", id)
 	}
-	m.Shutdown()
-	return nil
+	types.LogSummary(logger, "request(s)", len(args.ReqIds), errs)
+	return errors.Join(errs...)
 }
 
-func fetchRequest(reqId string, args types.Arguments) (igo.RequestWithManifests, error) {
-	rwm := igo.RequestWithManifests{}
-	reqUrl := args.SmileRequestUrl + reqId
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+// fetchAndPublishRequest fetches a request with its manifests from the SMILE
+// service and republishes it.  Requests skipped by the CMO filter are not an
+// error.
+func fetchAndPublishRequest(ctx context.Context, m *messaging.Messaging, id string, args types.Arguments, rl *slog.Logger) error {
+	ctx, span := tracer.Start(ctx, "request", trace.WithAttributes(attribute.String("request_id", id)))
+	defer span.End()
+	start := time.Now()
+
+	req, err := FetchRequest(ctx, id, args)
+	fetchedAt := time.Now()
 	if err != nil {
-		return rwm, err
+		rl.Error("Failure to fetch request", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
-	req.Header.Set("Accept", "application/json")
-	httpClient := &http.Client{}
-	resp, err := httpClient.Do(req)
+	if args.CMOReqs && !req.IsCmoRequest {
+		rl.Info("Skipping non-cmo request as 'cmo_requests_only (-c)' flag is set")
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return nil
+	}
+	out, err := proto.Marshal(req)
 	if err != nil {
-		return rwm, err
+		rl.Error("Failure to serialize request", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	md := messaging.Metadata{Source: messaging.SourceSmile, RequestId: id, RunId: args.RunId, Type: string(proto.MessageName(req)), FetchedAt: fetchedAt}
+	if err = m.PublishContext(ctx, args.SmilePubTop, out, md); err != nil {
+		rl.Error("Failure to publish request", "topic", args.SmilePubTop, "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
+	rl.Info("Successfully fetched and published request", "topic", args.SmilePubTop,
+		"duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// FetchRequest fetches a request with its sample manifests from the SMILE
+// request service.
+func FetchRequest(ctx context.Context, reqId string, args types.Arguments) (*igo.RequestWithManifests, error) {
+	reqUrl := args.SmileRequestUrl + url.PathEscape(reqId)
+	ctx = fetch.WithLimiter(ctx, limiter, "SMILE request service")
+	ctx = fetch.WithCallTimeout(ctx, 60*time.Second)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
 	if err != nil {
-		return rwm, err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return rwm, fmt.Errorf("HTTP return code != 200: %d\n", resp.StatusCode)
+	req.Header.Set("Accept", "application/json")
+
+	rwm := &igo.RequestWithManifests{}
+	if err := fetch.GetJSON("smileRequest", req, rwm); err != nil {
+		return nil, err
 	}
-	err = json.Unmarshal(body, &rwm)
-	return rwm, err
+	return rwm, nil
 }
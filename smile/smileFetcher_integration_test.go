@@ -5,13 +5,11 @@
 package smile
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"github.com/google/go-cmp/cmp"
-	igo "github.com/mskcc/smile-commons/types/igo/v1"
 	"github.com/mskcc/smile-message-publisher-go/types"
 	"google.golang.org/protobuf/testing/protocmp"
-	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -29,18 +27,8 @@ func TestMain(m *testing.M) {
 	os.Exit(exitVal)
 }
 
-func openExpected(t *testing.T) (igo.RequestWithManifests, error) {
-	rwm := igo.RequestWithManifests{}
-	jsonBytes, err := ioutil.ReadFile("testData/05274_C.json")
-	if err != nil {
-		return rwm, err
-	}
-	err = json.Unmarshal(jsonBytes, &rwm)
-	return rwm, err
-}
-
 func TestSmileFetcher_fetchRequestIntegration(t *testing.T) {
-	rwm, err := fetchRequest("05274_C", args)
+	rwm, err := FetchRequest(context.Background(), "05274_C", args)
 	if err != nil {
 		t.Error("Unexpected error: ", err)
 	}
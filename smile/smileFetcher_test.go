@@ -0,0 +1,41 @@
+package smile
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	igo "github.com/mskcc/smile-commons/types/igo/v1"
+	"github.com/mskcc/smile-message-publisher-go/fetch"
+	"github.com/mskcc/smile-message-publisher-go/types"
+	"google.golang.org/protobuf/testing/protocmp"
+	"os"
+	"testing"
+)
+
+func openExpected(t *testing.T) (*igo.RequestWithManifests, error) {
+	rwm := &igo.RequestWithManifests{}
+	jsonBytes, err := os.ReadFile("testdata/05274_C.json")
+	if err != nil {
+		return rwm, err
+	}
+	err = json.Unmarshal(jsonBytes, rwm)
+	return rwm, err
+}
+
+func TestSmileFetcher_FetchRequestReplay(t *testing.T) {
+	defer func() { fetch.HTTPClient.Transport = nil }()
+	fetch.HTTPClient.Transport = &fetch.ReplayTransport{SmileDir: "testdata"}
+	args := types.Arguments{SmileRequestUrl: "http://smile.example.org/request/"}
+
+	rwm, err := FetchRequest(context.Background(), "05274_C", args)
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	expected, err := openExpected(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expected, rwm, protocmp.Transform()); diff != "" {
+		t.Error(diff)
+	}
+}
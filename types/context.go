@@ -0,0 +1,55 @@
+package types
+
+import (
+	"context"
+	"log/slog"
+)
+
+type stopKey struct{}
+
+type loggerKey struct{}
+
+// WithStop returns a copy of ctx carrying stop, a channel closed to ask
+// long-running loops to finish their current item and then stop.  Closing
+// stop does not cancel ctx, so in-flight fetches and publishes complete.
+func WithStop(ctx context.Context, stop <-chan struct{}) context.Context {
+	return context.WithValue(ctx, stopKey{}, stop)
+}
+
+// Stopping returns the reason a loop should not start its next item: the
+// cause of ctx being cancelled, or ErrInterrupted if a stop was requested
+// with WithStop.  It returns nil if work may continue.
+func Stopping(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if stop, ok := ctx.Value(stopKey{}).(<-chan struct{}); ok {
+		select {
+		case <-stop:
+			return ErrInterrupted
+		default:
+		}
+	}
+	return nil
+}
+
+// StopRequested returns the channel attached to ctx with WithStop, closed
+// once a stop is requested, or nil if there is none.
+func StopRequested(ctx context.Context) <-chan struct{} {
+	stop, _ := ctx.Value(stopKey{}).(<-chan struct{})
+	return stop
+}
+
+// WithLogger returns a copy of ctx carrying l, used instead of the default
+// logger by the fetch and publish code called with ctx.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Logger returns the logger carried by ctx, or slog.Default().
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,31 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStopping(t *testing.T) {
+	stop := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = WithStop(ctx, stop)
+	if err := Stopping(ctx); err != nil {
+		t.Fatal("Unexpected stop: ", err)
+	}
+	if StopRequested(ctx) == nil || StopRequested(context.Background()) != nil {
+		t.Error("Unexpected stop channel")
+	}
+	close(stop)
+	if err := Stopping(ctx); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("Stopping() = %v, want %v", err, ErrInterrupted)
+	}
+	if ctx.Err() != nil {
+		t.Error("Requesting a stop cancelled the context")
+	}
+	cancel()
+	if err := Stopping(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Stopping() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,181 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors identifying the class of a fetch or publish failure.
+// Use errors.Is to test an error returned by the lims or smile packages
+// against one of these.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrTimeout      = errors.New("timeout")
+	ErrDecode       = errors.New("decode failure")
+	ErrPublish      = errors.New("publish failure")
+	ErrInterrupted  = errors.New("interrupted")
+)
+
+// MaxBodySnippet is the number of response body bytes kept on a FetchError.
+const MaxBodySnippet = 512
+
+// FetchError describes a failed HTTP fetch from LimsRest or the SMILE service.
+type FetchError struct {
+	Kind       error  // one of the sentinel errors above, nil if unclassified
+	URL        string // URL that was requested
+	StatusCode int    // HTTP status code, 0 if no response was received
+	Body       string // truncated response body
+	Err        error  // underlying cause, if any
+}
+
+func (e *FetchError) Error() string {
+	msg := fmt.Sprintf("fetch %s", e.URL)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": HTTP status %d", e.StatusCode)
+	}
+	if e.Kind != nil {
+		msg += fmt.Sprintf(" (%s)", e.Kind)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %s", e.Err)
+	}
+	if e.Body != "" {
+		msg += fmt.Sprintf(": %q", e.Body)
+	}
+	return msg
+}
+
+func (e *FetchError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// NewStatusError builds a FetchError for a non-200 response, classifying it
+// by status code.
+func NewStatusError(url string, status int, body []byte) *FetchError {
+	var kind error
+	switch status {
+	case http.StatusNotFound:
+		kind = ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		kind = ErrUnauthorized
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		kind = ErrTimeout
+	}
+	return &FetchError{Kind: kind, URL: url, StatusCode: status, Body: Snippet(body)}
+}
+
+// NewTransportError builds a FetchError for a request that received no
+// response, classifying deadline and network timeouts as ErrTimeout.
+func NewTransportError(url string, err error) *FetchError {
+	fe := &FetchError{URL: url, Err: err}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		fe.Kind = ErrTimeout
+	}
+	return fe
+}
+
+// NewDecodeError builds a FetchError for a response body that could not be
+// unmarshalled.
+func NewDecodeError(url string, body []byte, err error) *FetchError {
+	return &FetchError{Kind: ErrDecode, URL: url, StatusCode: http.StatusOK, Body: Snippet(body), Err: err}
+}
+
+// PublishError describes a failed publish to a NATS subject.
+type PublishError struct {
+	Topic string
+	Err   error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("publish to %s: %s", e.Topic, e.Err)
+}
+
+func (e *PublishError) Unwrap() []error {
+	return []error{ErrPublish, e.Err}
+}
+
+// Retryable reports whether err is a transient failure worth retrying.
+// Not-found, unauthorized and decode failures are permanent; timeouts,
+// publish failures, server errors and transport errors are not.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrDecode) {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrPublish) {
+		return true
+	}
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return fe.StatusCode == 0 || fe.StatusCode == http.StatusTooManyRequests || fe.StatusCode >= 500
+	}
+	return false
+}
+
+// Snippet truncates a response body to at most MaxBodySnippet bytes.
+func Snippet(body []byte) string {
+	if len(body) > MaxBodySnippet {
+		return string(body[:MaxBodySnippet]) + "..."
+	}
+	return string(body)
+}
+
+// kinds lists the error classes from most to least specific.
+var kinds = []error{ErrNotFound, ErrUnauthorized, ErrTimeout, ErrDecode, ErrPublish, ErrInterrupted}
+
+// Kind returns the sentinel error classifying err, or nil if it is not one
+// of the classes above.
+func Kind(err error) error {
+	for _, k := range kinds {
+		if errors.Is(err, k) {
+			return k
+		}
+	}
+	return nil
+}
+
+// SummarizeErrors returns a short count of errs by class, e.g.
+// "2 not found, 1 timeout".
+func SummarizeErrors(errs []error) string {
+	counts := map[error]int{}
+	for _, err := range errs {
+		counts[Kind(err)]++
+	}
+	var parts []string
+	for _, k := range kinds {
+		if c := counts[k]; c > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", c, k))
+		}
+	}
+	if c := counts[nil]; c > 0 {
+		parts = append(parts, fmt.Sprintf("%d other", c))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LogSummary logs the outcome of a run through total items, e.g.
+// "request(s)", with a summary of errs if any.
+func LogSummary(logger *slog.Logger, items string, total int, errs []error) {
+	if len(errs) == 0 {
+		logger.Info("Completed "+items+" without failure", "total", total)
+		return
+	}
+	logger.Warn("Completed "+items+" with failures", "total", total, "failures", len(errs),
+		"failure_summary", SummarizeErrors(errs))
+}
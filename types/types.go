@@ -1,32 +1,87 @@
 package types
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 )
 
+// Version of the publisher, set at build time with
+// -ldflags "-X github.com/mskcc/smile-message-publisher-go/types.Version=..."
+var Version = "dev"
+
+// NATS authentication modes, selected with the nats.auth config property.
+const (
+	NatsAuthTLS   = "tls"   // client certificate plus user/password
+	NatsAuthPlain = "plain" // no TLS, optional user/password
+	NatsAuthToken = "token"
+	NatsAuthNkey  = "nkey"  // NKey seed file
+	NatsAuthCreds = "creds" // JWT credentials file
+)
+
 type Arguments struct {
 	LimsHost          string
 	LimsUser          string
 	LimsPW            string
+	LimsScheme        string // https unless set, http for a local fake-lims
 	LimsPubTop        string
+	LimsSampleTop     string // Topic single sample manifests are published to
 	DateMode          bool
 	StartDate         time.Time
 	EndDate           time.Time
 	ReqIdMode         bool
 	ReqIds            []string
+	SampleMode        bool
+	SampleIds         []string
 	JSONFileMode      bool
 	JSONFilePath      string
 	PublisherFileMode bool
 	PublisherFilePath string
 	SmileServiceMode  bool
+	RetryMode         bool // Retry the requests in the dead-letter file
+	ResumeMode        bool // Resume the run RunId from its journal
+	APIMode           bool // Publish requests received through the API
+	RecordMode        bool // Record test fixtures instead of publishing
 	CMOReqs           bool // Only fetch CMO Requests
+	DryRun            bool // Fetch and serialize without publishing
 	NatsUrl           string
+	NatsAuth          string // One of the NatsAuth constants
 	NatsConName       string
 	NatsConPw         string
 	NatsKeyPath       string
 	NatsTrustPath     string
+	NatsToken         string
+	NatsNkeySeedPath  string
+	NatsCredsPath     string
 	SmileRequestUrl   string
 	SmilePubTop       string
+	NatsHeaders       map[string]string // Extra static headers for every message
+	NatsJetStream     bool              // Publish via JetStream and wait for a PubAck
+	NatsAckTimeout    time.Duration     // How long to wait for a PubAck
+	NatsStream        string            // Stream expected to acknowledge publishes
+	NatsFlushTimeout  time.Duration     // How long to wait flushing and draining on exit
+	NatsCommandSubj   string            // Subject the serve command takes commands on, none when empty
+	NatsCommandQueue  string            // Queue group shared by serve commands subscribed to NatsCommandSubj
+	NatsCommandLimit  int               // Commands the serve command runs at once; others are replied to as busy
+	LimsFailureGrace  time.Duration     // How long LimsRest calls may fail before serve is not ready
+	RunId             string            // Identifies this run in message headers and logs
+	Profile           string            // Config profile applied over the base sections
+	ProfileProtected  bool              // Profile requires confirmation before publishing
+	DebugHTTPDir      string            // Dump HTTP request/response pairs here when set
+	MetricsAddr       string            // Serve Prometheus metrics here when set
+	MetricsTextfile   string            // Write Prometheus metrics here on exit when set
+	TraceExporter     string            // none, stdout or otlp
+	TraceEndpoint     string            // OTLP/HTTP collector address
+	OverallTimeout    time.Duration     // Deadline for the whole run, none when zero
+	LimsRateLimit     float64           // LimsRest requests per second, unlimited when zero
+	LimsRateBurst     int               // Largest burst of LimsRest requests allowed
+	SmileRateLimit    float64           // SMILE request service requests per second, unlimited when zero
+	SmileRateBurst    int               // Largest burst of SMILE requests allowed
+	CacheDir          string            // Cache LimsRest responses here when set
+	CacheTTL          time.Duration     // Age after which cached responses are revalidated
+	CacheMode         string            // use, only or refresh, see fetch.EnableCache
+	DeadLetterPath    string            // Append failed requests here when set
+	JournalDir        string            // Journal run progress here when set
 }
 
 type Config struct {
@@ -34,3 +89,35 @@ type Config struct {
 	Type string
 	Path string
 }
+
+// Mode names the run mode selected by the arguments, for use in logs.
+func (a Arguments) Mode() string {
+	switch {
+	case a.ReqIdMode:
+		return "request_ids"
+	case a.DateMode:
+		return "date"
+	case a.SampleMode:
+		return "sample_ids"
+	case a.JSONFileMode:
+		return "json_file"
+	case a.PublisherFileMode:
+		return "publisher_file"
+	case a.SmileServiceMode:
+		return "smile_service"
+	case a.RetryMode:
+		return "retry_failed"
+	case a.ResumeMode:
+		return "resume"
+	case a.APIMode:
+		return "api"
+	}
+	return ""
+}
+
+// NewRunId returns a sortable id unique to a run of the publisher.
+func NewRunId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}